@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"myq-teslamate-geofence/internal/garage"
+	geo "myq-teslamate-geofence/internal/geo"
+	"myq-teslamate-geofence/internal/publish"
+	t "myq-teslamate-geofence/internal/types"
+
+	"gopkg.in/yaml.v3"
+)
+
+// prefix of the topics teslamate publishes car data to, unless mqtt_topic_prefix is set
+const defaultTopicPrefix = "teslamate/cars"
+
+// load yaml config from path, or from env vars if path is empty, into config, apply env var overrides, and
+// validate it; warnings aren't logged, see logConfigWarnings
+func loadConfig(path string, config *t.ConfigStruct) error {
+	if err := readConfig(path, config); err != nil {
+		return err
+	}
+
+	for _, car := range config.Cars {
+		// convert single garage door configs to a garage_doors entry for backward compatibility
+		if car.MyQSerial != "" {
+			car.GarageDoors = append(car.GarageDoors, &t.GarageDoor{
+				MyQSerial:      car.MyQSerial,
+				GarageCloseGeo: car.GarageCloseGeo,
+				GarageOpenGeo:  car.GarageOpenGeo,
+			})
+		}
+
+		car.CarState = &t.CarState{}
+		for _, door := range car.GarageDoors {
+			door.DoorState = &t.DoorState{} // AtHome is set from the car's first position
+		}
+	}
+
+	if err := checkEnvVars(config); err != nil {
+		return err
+	}
+	if err := config.ResolveLocations(); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// read yaml config from path, or from env vars if path is empty, into config without validating it
+func readConfig(path string, config *t.ConfigStruct) error {
+	if path == "" {
+		if err := loadEnvConfig(config); err != nil {
+			return err
+		}
+	} else {
+		yamlFile, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read config file: %v", err)
+		}
+		if err := yaml.Unmarshal(yamlFile, config); err != nil {
+			return fmt.Errorf("could not load yaml from config file: %v", err)
+		}
+	}
+
+	if config.Global.MqttTopicPrefix == "" {
+		config.Global.MqttTopicPrefix = defaultTopicPrefix
+	}
+	config.Global.MqttTopicPrefix = strings.TrimSuffix(config.Global.MqttTopicPrefix, "/")
+	return nil
+}
+
+// env vars that configure a single car with a single garage door when there's no config file, and the config
+// setting each one sets
+var (
+	envGlobalSettings = [][2]string{
+		{"MQTT_HOST", "mqtt_host"},
+		{"MQTT_PORT", "mqtt_port"},
+		{"MQTT_CLIENT_ID", "mqtt_client_id"},
+		{"MQTT_USE_TLS", "mqtt_use_tls"},
+		{"COOLDOWN", "cooldown"},
+	}
+	envCarSettings = [][2]string{
+		{"TESLAMATE_CAR_ID", "teslamate_car_id"},
+		{"CONTROLLER", "controller"},
+		{"TRIGGER_ON_GEOFENCE_NAME", "trigger_on_geofence_name"},
+	}
+)
+
+// returns true if the config can be read from env vars instead of a file, from CONFIG_YAML or, for a single car,
+// the env vars in envGlobalSettings and envCarSettings
+func envConfigDefined() bool {
+	for _, name := range []string{"CONFIG_YAML", "TESLAMATE_CAR_ID", "MQTT_HOST"} {
+		if _, exists := os.LookupEnv(name); exists {
+			return true
+		}
+	}
+	return false
+}
+
+// decode the config from env vars, for running without a config file: CONFIG_YAML holds a complete yaml config,
+// otherwise a single car is configured from envGlobalSettings, envCarSettings, MYQ_SERIAL, and the geofence set
+// by GEO_CENTER, CLOSE_RADIUS, and OPEN_RADIUS. values are parsed the same as in a config file, e.g. radii can
+// have units
+func loadEnvConfig(config *t.ConfigStruct) error {
+	if value, exists := os.LookupEnv("CONFIG_YAML"); exists {
+		if err := yaml.Unmarshal([]byte(value), config); err != nil {
+			return fmt.Errorf("could not load yaml from CONFIG_YAML: %v", err)
+		}
+		return nil
+	}
+
+	global := envMapping(envGlobalSettings)
+	car := envMapping(envCarSettings)
+	door := envMapping([][2]string{{"MYQ_SERIAL", "myq_serial"}})
+	for _, geofence := range [][2]string{{"CLOSE_RADIUS", "garage_close_geofence"}, {"OPEN_RADIUS", "garage_open_geofence"}} {
+		if _, exists := os.LookupEnv(geofence[0]); exists {
+			door.Content = append(door.Content, yamlScalar(geofence[1]),
+				envMapping([][2]string{{"GEO_CENTER", "geo_center"}, {geofence[0], "geo_radius"}}))
+		}
+	}
+	car.Content = append(car.Content, yamlScalar("garage_doors"), &yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{door}})
+	root := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		yamlScalar("global"), global,
+		yamlScalar("cars"), {Kind: yaml.SequenceNode, Content: []*yaml.Node{car}},
+	}}
+	if err := root.Decode(config); err != nil {
+		return fmt.Errorf("could not load config from env vars: %v", err)
+	}
+	return nil
+}
+
+// returns a yaml mapping of each config setting to the value of its env var, skipping unset env vars
+func envMapping(settings [][2]string) *yaml.Node {
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	for _, setting := range settings {
+		if value, exists := os.LookupEnv(setting[0]); exists {
+			mapping.Content = append(mapping.Content, yamlScalar(setting[1]), yamlScalar(value))
+		}
+	}
+	return mapping
+}
+
+// returns a plain yaml scalar, whose type is resolved from its value as if it were written in a config file
+func yamlScalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+}
+
+// log each of configWarnings
+func logConfigWarnings(config t.ConfigStruct) {
+	for _, warning := range configWarnings(config) {
+		slog.Warn("Config warning", "warning", warning)
+	}
+}
+
+// returns warnings about a valid config that may not do what's intended, such as overlapping geofences or
+// deprecated settings
+func configWarnings(config t.ConfigStruct) []string {
+	var warnings []string
+	if config.Global.MqttTLSInsecure {
+		warnings = append(warnings, "mqtt_tls_insecure is enabled, so the MQTT broker's certificate ISN'T VERIFIED and anyone who can intercept the connection can impersonate the broker; use mqtt_tls_ca_cert to trust a self-signed certificate instead")
+	}
+	for _, overlap := range geo.OverlapWarnings(config) {
+		warnings = append(warnings, overlap+", so a car in both could operate both doors")
+	}
+	for _, car := range config.Cars {
+		if !car.IsEnabled() {
+			warnings = append(warnings, fmt.Sprintf("car %d is disabled, so its positions are ignored and it won't operate any garage doors", car.CarID))
+			continue
+		}
+		if car.InvertActions {
+			warnings = append(warnings, fmt.Sprintf("car %d: invert_actions is enabled, so its garage doors will OPEN when it LEAVES and CLOSE when it ARRIVES", car.CarID))
+		}
+		if car.MyQSerial != "" {
+			warnings = append(warnings, fmt.Sprintf("car %d: myq_serial, garage_close_geofence, and garage_open_geofence on the car are deprecated, move them to an entry in garage_doors", car.CarID))
+		}
+		if car.TriggerOnGeofenceName != "" {
+			continue
+		}
+		for _, door := range car.GarageDoors {
+			for _, geofence := range []struct {
+				name string
+				g    t.Geofence
+			}{{"garage_close_geofence", door.GarageCloseGeo}, {"garage_open_geofence", door.GarageOpenGeo}} {
+				if len(geofence.g.Polygon) > 0 || geofence.g.Radius == 0 {
+					continue
+				}
+				if geofence.g.Radius < 1 {
+					warnings = append(warnings, fmt.Sprintf("car %d, door %s: %s geo_radius is %vm; in earlier versions a geo_radius without a unit was in kilometers, so add a unit such as km or m",
+						car.CarID, door.MyQSerial, geofence.name, float64(geofence.g.Radius)))
+				}
+			}
+			// the open geofence falls back to the close geofence if it isn't defined
+			closeGeo, openGeo := door.GarageCloseGeo, door.GarageOpenGeo
+			if !openGeo.Defined() {
+				openGeo = closeGeo
+			}
+			if len(openGeo.Polygon) == 0 && len(openGeo.Geofences) == 0 && car.GeofenceBuffer > 0 && car.GeofenceBuffer >= openGeo.Radius {
+				warnings = append(warnings, fmt.Sprintf("car %d, door %s: geofence_buffer (%vm) isn't smaller than the open geofence's geo_radius (%vm), so the car can never be far enough inside it to open the door",
+					car.CarID, door.MyQSerial, float64(car.GeofenceBuffer), float64(openGeo.Radius)))
+			}
+			if len(closeGeo.Polygon) == 0 && len(openGeo.Polygon) == 0 && openGeo.Radius != 0 && closeGeo.Radius > openGeo.Radius {
+				warnings = append(warnings, fmt.Sprintf("car %d, door %s: garage_close_geofence (%vm) is larger than garage_open_geofence (%vm); usually the open geofence is larger so the door opens before arriving",
+					car.CarID, door.MyQSerial, float64(closeGeo.Radius), float64(openGeo.Radius)))
+			}
+		}
+	}
+	return warnings
+}
+
+// returns the current config; used by readers outside the main loop, which is the only writer
+func currentConfig() t.ConfigStruct {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return Config
+}
+
+// reload the config file, keeping the runtime state of cars and garage doors that still exist; if the new
+// config can't be loaded, the current config is kept
+func reloadConfig(client mqtt.Client, messageChan chan<- mqtt.Message) {
+	// flags and env vars that aren't part of the config file carry over
+	newConfig := t.ConfigStruct{
+		Testing: Config.Testing,
+		Debug:   Config.Debug,
+		DryRun:  Config.DryRun,
+	}
+	if err := loadConfig(configFile, &newConfig); err != nil {
+		slog.Error("Could not reload config, keeping current config", "error", err)
+		return
+	}
+	logConfigWarnings(newConfig)
+
+	oldCars := map[int]*t.Car{}
+	for _, car := range Config.Cars {
+		oldCars[car.CarID] = car
+	}
+
+	var added, updated, removed []int
+	for _, car := range newConfig.Cars {
+		oldCar, exists := oldCars[car.CarID]
+		if !exists {
+			added = append(added, car.CarID)
+			continue
+		}
+		updated = append(updated, car.CarID)
+		delete(oldCars, car.CarID)
+
+		// share the existing state so that in-flight operations on the old car are reflected
+		car.CarState = oldCar.CarState
+		for _, door := range car.GarageDoors {
+			for _, oldDoor := range oldCar.GarageDoors {
+				if door.MyQSerial == oldDoor.MyQSerial {
+					door.DoorState = oldDoor.DoorState
+				}
+			}
+		}
+		// a car that was disabled may have come or gone since, so its next position only sets whether it's home
+		if car.IsEnabled() && !oldCar.IsEnabled() {
+			car.Lock()
+			for _, door := range car.GarageDoors {
+				door.Initialized = false
+			}
+			car.Unlock()
+			slog.Info("Car enabled, its garage doors will be initialized from its next position", "car_id", car.CarID)
+		}
+	}
+
+	for _, car := range oldCars {
+		removed = append(removed, car.CarID)
+	}
+
+	garage.ResetMissingDevices() // a corrected myq_serial should be tried again
+	oldConfig := Config
+	configLock.Lock()
+	Config = newConfig
+	configLock.Unlock()
+	configureLogger()
+
+	if err := garage.SubscribeRatgdo(client, Config); err != nil {
+		slog.Error("Could not subscribe to ratgdo topics", "error", err)
+	}
+	// the wildcard subscription covers added and removed cars, so it only changes with the prefix or qos
+	if oldPrefix, newPrefix := oldConfig.Global.MqttTopicPrefix, Config.Global.MqttTopicPrefix; oldPrefix != newPrefix || oldConfig.Global.MqttQoS != Config.Global.MqttQoS {
+		unsubscribeTopics(client, oldPrefix)
+		subscribeTopics(client, newPrefix, messageChan)
+	}
+
+	if oldTopic, newTopic := publish.ControlTopic(oldConfig), publish.ControlTopic(Config); oldTopic != newTopic {
+		if token := client.Unsubscribe(oldTopic); token.Wait() && token.Error() != nil {
+			slog.Error("Could not unsubscribe from control topic", "error", token.Error())
+		}
+		subscribeControl(client, Config)
+	}
+
+	if oldConfig.Global.HomeAssistantDiscovery {
+		if token := client.Unsubscribe(publish.DoorCommandTopic(oldConfig)); token.Wait() && token.Error() != nil {
+			slog.Error("Could not unsubscribe from door commands", "error", token.Error())
+		}
+	}
+	if Config.Global.HomeAssistantDiscovery {
+		publish.Discovery(Config)
+		subscribeDoorCommands(client, Config)
+	}
+
+	slog.Info("Config reloaded", "added_cars", added, "updated_cars", updated, "removed_cars", removed)
+}
+
+// override config with env vars (or files named by <name>_FILE env vars) if present, and validate that a
+// myq_email and myq_pass exists
+func checkEnvVars(config *t.ConfigStruct) error {
+	for name, field := range map[string]*string{
+		"MYQ_EMAIL": &config.Global.MyQEmail,
+		"MYQ_PASS":  &config.Global.MyQPass,
+		"API_TOKEN": &config.Global.APIToken,
+		"MQTT_USER": &config.Global.MqttUsername,
+		"MQTT_PASS": &config.Global.MqttPassword,
+	} {
+		value, exists, err := lookupSecret(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			*field = value
+		}
+	}
+	// global credentials are only needed when a myq car doesn't have its own, or when listing myq devices, and
+	// not at all when discovering cars
+	if GetDevices || (!DiscoverCars && garage.UsesGlobalMyQAccount(*config)) {
+		if config.Global.MyQEmail == "" || config.Global.MyQPass == "" {
+			return fmt.Errorf("MYQ_EMAIL and MYQ_PASS must be defined in the config file or as env vars")
+		}
+	}
+	return nil
+}
+
+// look up a secret from the file named by the <name>_FILE env var (e.g. a docker secret), falling back to
+// the <name> env var; trailing newlines are trimmed from files
+func lookupSecret(name string) (value string, exists bool, err error) {
+	if path, exists := os.LookupEnv(name + "_FILE"); exists {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("could not read %s_FILE: %v", name, err)
+		}
+		return strings.TrimRight(string(contents), "\r\n"), true, nil
+	}
+	value, exists = os.LookupEnv(name)
+	return value, exists, nil
+}
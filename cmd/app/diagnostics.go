@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"myq-teslamate-geofence/internal/garage"
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// check that each configured MyQ garage door can be read with its car's credentials, printing a pass or
+// fail line per door and a summary; returns false if any check failed
+func testMyQ(config t.ConfigStruct) bool {
+	passed, failed := 0, 0
+	for _, car := range config.Cars {
+		for _, door := range car.GarageDoors {
+			if car.Controller != "" && car.Controller != garage.ControllerMyQ {
+				fmt.Printf("SKIP car %d, door %s: uses the %s controller\n", car.CarID, door.MyQSerial, car.Controller)
+				continue
+			}
+			state, err := garage.ForCar(config, car).State(door.MyQSerial)
+			if err != nil {
+				failed++
+				fmt.Printf("FAIL car %d, door %s: %v\n", car.CarID, door.MyQSerial, err)
+				continue
+			}
+			passed++
+			fmt.Printf("PASS car %d, door %s: %s\n", car.CarID, door.MyQSerial, state)
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	return failed == 0
+}
+
+// check that each configured MyQ serial is on its account before listening for positions, so a mistyped serial
+// is caught at startup rather than on the first drive; exits if any are missing, but only warns if MyQ can't be
+// reached, since the doors may still work once it can
+func checkSerials(config t.ConfigStruct) {
+	if SkipSerialCheck || config.Testing || config.DryRun || !garage.UsesMyQ(config) {
+		return
+	}
+	err := garage.CheckSerials(config)
+	if errors.Is(err, garage.ErrDeviceNotFound) {
+		fatal("Garage door serial not found on MyQ account; check myq_serial in the config, or run with -d to list serials", "error", err)
+	} else if err != nil {
+		slog.Warn("Could not check garage door serials against MyQ, continuing", "error", err)
+		return
+	}
+	slog.Info("All garage door serials found on their MyQ accounts")
+}
+
+// load and validate the config file without connecting to MQTT or MyQ, printing any problems and warnings
+// along with a summary of each car's garage doors; returns false if the config is invalid
+func checkConfig(path string) bool {
+	if path == "" {
+		fmt.Println("Checking config from environment variables")
+	} else {
+		fmt.Printf("Checking %s\n", path)
+	}
+	var config t.ConfigStruct
+	if err := loadConfig(path, &config); err != nil {
+		fmt.Printf("INVALID: %v\n", err)
+		return false
+	}
+	for _, car := range config.Cars {
+		controller := car.Controller
+		if controller == "" {
+			controller = garage.ControllerMyQ
+		}
+		fmt.Printf("car %d (%s):\n", car.CarID, controller)
+		for _, door := range car.GarageDoors {
+			if car.TriggerOnGeofenceName != "" {
+				fmt.Printf("  door %s: teslamate geofence %q\n", door.MyQSerial, car.TriggerOnGeofenceName)
+				continue
+			}
+			fmt.Printf("  door %s: close %s, open %s\n", door.MyQSerial, describeGeofence(door.GarageCloseGeo), describeGeofence(door.GarageOpenGeo))
+		}
+	}
+	warnings := configWarnings(config)
+	for _, warning := range warnings {
+		fmt.Printf("WARNING: %s\n", warning)
+	}
+	fmt.Printf("OK: config is valid with %d warning(s)\n", len(warnings))
+	return true
+}
+
+// returns a short description of a geofence's shape for checkConfig
+func describeGeofence(geofence t.Geofence) string {
+	switch {
+	case len(geofence.Geofences) > 0:
+		descriptions := make([]string, len(geofence.Geofences))
+		for i, g := range geofence.Geofences {
+			descriptions[i] = describeGeofence(g)
+		}
+		return fmt.Sprintf("%s of [%s]", geofence.MatchMode(), strings.Join(descriptions, "; "))
+	case len(geofence.Polygon) > 0:
+		return fmt.Sprintf("polygon of %d points", len(geofence.Polygon))
+	case geofence.Radius == 0:
+		return "same as the other geofence"
+	}
+	center := fmt.Sprintf("(%f, %f)", geofence.Center.Lat, geofence.Center.Lng)
+	if geofence.Location != "" {
+		center = geofence.Location + " " + center
+	}
+	return fmt.Sprintf("%vm around %s", float64(geofence.Radius), center)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// how long --discover-cars listens for cars by default; teslamate retains its topics, so they normally arrive
+// right after subscribing
+const defaultDiscoverDuration = 5 * time.Second
+
+// a car found by --discover-cars
+type discoveredCar struct {
+	CarID       int    `json:"teslamate_car_id"`
+	DisplayName string `json:"display_name"`
+}
+
+// listen to teslamate's display_name topics under the configured prefix for the duration and print each car id
+// and name seen, as text or json. the connection uses its own client id so that it doesn't disconnect a running
+// instance of the app
+func discoverCars(config t.ConfigStruct, format string, duration time.Duration) error {
+	opts := mqttOptions(config)
+	opts.SetClientID(config.Global.MqttClientID + "-discover")
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not connect to mqtt broker: %v", token.Error())
+	}
+	defer client.Disconnect(250)
+
+	var lock sync.Mutex
+	names := map[int]string{}
+	topic := config.Global.MqttTopicPrefix + "/+/display_name"
+	if token := client.Subscribe(topic, 0, func(client mqtt.Client, message mqtt.Message) {
+		carID, _, ok := parseTopic(config.Global.MqttTopicPrefix, message.Topic())
+		if !ok {
+			return
+		}
+		lock.Lock()
+		names[carID] = string(message.Payload())
+		lock.Unlock()
+	}); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not subscribe to %s: %v", topic, token.Error())
+	}
+	if format != "json" {
+		fmt.Printf("Listening for cars on %s for %s...\n", topic, duration)
+	}
+	time.Sleep(duration)
+
+	lock.Lock()
+	defer lock.Unlock()
+	cars := []discoveredCar{}
+	for carID, name := range names {
+		cars = append(cars, discoveredCar{CarID: carID, DisplayName: name})
+	}
+	sort.Slice(cars, func(i, j int) bool { return cars[i].CarID < cars[j].CarID })
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(cars)
+	}
+	if len(cars) == 0 {
+		fmt.Println("No cars found; check that mqtt_topic_prefix matches TeslaMate and that TeslaMate is publishing to the broker")
+		return nil
+	}
+	for _, car := range cars {
+		fmt.Printf("teslamate_car_id: %d (%s)\n", car.CarID, car.DisplayName)
+	}
+	return nil
+}
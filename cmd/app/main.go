@@ -1,41 +1,112 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	_ "time/tzdata" // embed time zones for active_hours on systems without a time zone database
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"myq-teslamate-geofence/internal/garage"
 	geo "myq-teslamate-geofence/internal/geo"
+	"myq-teslamate-geofence/internal/publish"
+	"myq-teslamate-geofence/internal/server"
 	t "myq-teslamate-geofence/internal/types"
+)
+
+// how long to wait for the matching coordinate of a lat/lng pair before evaluating with what we have
+const coordinatePairWindow = 2 * time.Second
+
+// how long after connecting to wait for each car's topics before warning about any that haven't published;
+// teslamate retains its topics, so they normally arrive right after subscribing
+const topicCheckDelay = 2 * time.Minute
 
-	"gopkg.in/yaml.v3"
+// how long to wait on shutdown for in-flight garage door operations to finish
+const shutdownTimeout = 90 * time.Second
+
+// number of geofence checks that can wait for a car's worker before more are dropped
+const carQueueSize = 4
+
+// build info, set with -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
 )
 
 var (
-	debug      bool
-	configFile string
-	Config     t.ConfigStruct
-	GetDevices bool
+	configFile  string
+	Config      t.ConfigStruct
+	configLock  sync.RWMutex // guards Config against reloads for readers outside the main loop
+	GetDevices  bool
+	Format      string
+	DeviceType  string
+	TestMyQ     bool
+	CheckConfig bool
+
+	SkipSerialCheck bool
+
+	TraceMqtt    bool
+	LogPrecision int
+
+	DiscoverCars     bool
+	DiscoverDuration time.Duration
+
+	ReplayFile     string
+	ReplayCarID    int
+	ReplayInterval time.Duration
+
+	// cancelled on shutdown to stop waiting for garage doors that are being operated
+	appCtx, cancelApp = context.WithCancel(context.Background())
+
+	inFlight          sync.WaitGroup // in-flight geofence checks, waited on at shutdown
+	pendingOperations atomic.Int32   // number of in-flight geofence checks, for logging
 )
 
-func init() {
-	log.SetOutput(os.Stdout)
+// parse the args and load the config for the mode being run
+func setup() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, nil)))
 	parseArgs()
-	if !GetDevices {
-		loadConfig()
+	if GetDevices {
+		if err := checkEnvVars(&Config); err != nil {
+			fatal(err.Error())
+		}
+		return
+	}
+	if CheckConfig {
+		return // the config is loaded and reported on by checkConfig
+	}
+	if DiscoverCars {
+		// only the mqtt settings are needed, so the config doesn't have to define any cars yet
+		if err := readConfig(configFile, &Config); err != nil {
+			fatal("Could not load config", "error", err)
+		}
+		if err := checkEnvVars(&Config); err != nil {
+			fatal(err.Error())
+		}
+		return
 	}
-	checkEnvVars()
-	for _, car := range Config.Cars {
-		car.AtHome = true // set default to true
+	if err := loadConfig(configFile, &Config); err != nil {
+		fatal("Could not load config", "error", err)
 	}
+	logConfigWarnings(Config)
+	slog.Info("Config loaded successfully")
 }
 
 // parse args
@@ -44,157 +115,772 @@ func parseArgs() {
 	flag.StringVar(&configFile, "config", "", "location of config file")
 	flag.StringVar(&configFile, "c", "", "location of config file")
 	flag.BoolVar(&Config.Testing, "testing", false, "test case")
+	flag.BoolVar(&Config.DryRun, "dry-run", false, "log intended garage door actions without operating the door")
 	flag.BoolVar(&GetDevices, "d", false, "get myq devices")
+	flag.StringVar(&Format, "format", "text", "output format of -d, text or json")
+	flag.StringVar(&DeviceType, "type", "", "only list devices with -d whose type contains this, e.g. garagedoor")
+	flag.BoolVar(&TestMyQ, "test-myq", false, "check that each configured myq garage door can be read, then exit")
+	flag.BoolVar(&SkipSerialCheck, "skip-serial-check", false, "don't check that each configured myq serial is on its account at startup")
+	flag.BoolVar(&CheckConfig, "check-config", false, "validate the config file and print a report, then exit")
+	flag.StringVar(&ReplayFile, "replay", "", "replay a gpx or csv track through the geofences in dry run mode, then exit")
+	flag.IntVar(&ReplayCarID, "replay-car", 0, "teslamate car id to replay the track for; defaults to the first car")
+	flag.DurationVar(&ReplayInterval, "replay-interval", 0, "time to wait between replayed points")
+	flag.BoolVar(&DiscoverCars, "discover-cars", false, "list the teslamate car ids and names published to mqtt, then exit")
+	flag.DurationVar(&DiscoverDuration, "discover-duration", defaultDiscoverDuration, "how long to listen for cars with --discover-cars")
+	flag.BoolVar(&TraceMqtt, "trace-mqtt", false, "log every message received from the mqtt broker")
+	flag.IntVar(&LogPrecision, "log-precision", -1, "round latitudes and longitudes in logs to this many decimal places; defaults to full precision")
+	var printVersion bool
+	flag.BoolVar(&printVersion, "version", false, "print version info and exit")
+	flag.BoolVar(&printVersion, "v", false, "print version info and exit")
 	flag.Parse()
 
+	if Format != "text" && Format != "json" {
+		fatal("Format must be text or json", "format", Format)
+	}
+
+	if printVersion {
+		fmt.Printf("myq-teslamate-geofence %s (commit %s, built %s)\n", version, commit, date)
+		os.Exit(0)
+	}
+
 	// only check for config if not getting devices
 	if !GetDevices {
 		// if -c or --config wasn't passed, check for CONFIG_FILE env var
-		// if that fails, check for file at default location
+		// if that isn't set either, the config is read from env vars
 		if configFile == "" {
 			var exists bool
-			if configFile, exists = os.LookupEnv("CONFIG_FILE"); !exists {
-				log.Fatalf("Config file must be defined with '-c' or 'CONFIG_FILE' environment variable")
+			if configFile, exists = os.LookupEnv("CONFIG_FILE"); !exists && !envConfigDefined() {
+				fatal("Config file must be defined with '-c' or 'CONFIG_FILE' environment variable, or the config with 'CONFIG_YAML' or 'TESLAMATE_CAR_ID' and related environment variables")
 			}
 		}
 
 		// check that ConfigFile exists
-		if _, err := os.Stat(configFile); err != nil {
-			log.Fatalf("Config file %v doesn't exist!", configFile)
+		if _, err := os.Stat(configFile); configFile != "" && err != nil {
+			fatal("Config file doesn't exist!", "config_file", configFile)
 		}
 	}
 }
 
-// load yaml config
-func loadConfig() {
-	yamlFile, err := os.ReadFile(configFile)
-	if err != nil {
-		log.Fatalf("Could not read config file: %v", err)
-	}
-
-	err = yaml.Unmarshal(yamlFile, &Config)
-	if err != nil {
-		log.Fatalf("Could not load yaml from config file, received error: %v", err)
-	}
-	log.Println("Config loaded successfully")
-}
-
 func main() {
+	setup()
 	if GetDevices {
-		geo.GetGarageDoorSerials(Config)
+		if Format == "json" {
+			// keep stdout clean for the json output
+			slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+		}
+		if err := garage.GetGarageDoorSerials(Config, Format, DeviceType); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if CheckConfig {
+		if !checkConfig(configFile) {
+			os.Exit(1)
+		}
+		return
+	}
+	if DiscoverCars {
+		if err := discoverCars(Config, Format, DiscoverDuration); err != nil {
+			fatal("Could not discover cars", "error", err)
+		}
+		return
+	}
+	if TestMyQ {
+		if !testMyQ(Config) {
+			os.Exit(1)
+		}
+		return
+	}
+	if ReplayFile != "" {
+		configureLogger()
+		if err := replay(Config, ReplayFile, ReplayCarID, ReplayInterval); err != nil {
+			fatal("Could not replay track", "error", err)
+		}
 		return
 	}
 	if value, exists := os.LookupEnv("TESTING"); exists {
 		Config.Testing, _ = strconv.ParseBool(value)
 	}
+	if value, exists := os.LookupEnv("DRY_RUN"); exists {
+		Config.DryRun, _ = strconv.ParseBool(value)
+	}
 	if value, exists := os.LookupEnv("DEBUG"); exists {
-		debug, _ = strconv.ParseBool(value)
+		Config.Debug, _ = strconv.ParseBool(value)
 	}
-	fmt.Println()
+	configureLogger()
+	slog.Info("Starting myq-teslamate-geofence", "version", version, "commit", commit, "build_date", date)
+	loadState(Config)
+	checkSerials(Config)
 
-	// create a new MQTT client
-	opts := mqtt.NewClientOptions()
-	opts.SetOrderMatters(false)
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", Config.Global.MqttHost, Config.Global.MqttPort))
-	opts.SetClientID(Config.Global.MqttClientID)
+	messageChan := make(chan mqtt.Message)
+	client := newClient(messageChan)
 
-	// create a new MQTT client object
-	client := mqtt.NewClient(opts)
+	if Config.Global.MetricsPort > 0 {
+		server.Handle(Config.Global.MetricsPort, "/metrics", promhttp.Handler())
+	}
+	if Config.Global.HealthPort > 0 {
+		myqReady := func() bool {
+			config := currentConfig()
+			return config.Testing || config.DryRun || !garage.UsesMyQ(config) || garage.HasSession(config)
+		}
+		server.Handle(Config.Global.HealthPort, "/healthz", server.HealthHandler(client.IsConnected))
+		server.Handle(Config.Global.HealthPort, "/readyz", server.HealthHandler(client.IsConnected, myqReady))
+		if !Config.Testing && !Config.DryRun && garage.UsesMyQ(Config) {
+			go garage.InitSession(Config) // acquire a session up front so readiness doesn't wait on the first door action
+		}
+	}
+	if Config.Global.WebUIPort > 0 {
+		server.Handle(Config.Global.WebUIPort, "/", server.DashboardHandler(currentConfig))
+	}
+	if Config.Global.APIPort > 0 {
+		server.Handle(Config.Global.APIPort, "/cars/", server.RequireToken(Config.Global.APIToken, trackInFlight(server.DoorActionHandler(currentConfig))))
+		server.Handle(Config.Global.APIPort, "/state", server.RequireToken(Config.Global.APIToken, server.StateHandler(currentConfig)))
+	}
+	server.Start()
 
-	// connect to the MQTT broker
+	// connect to the MQTT broker, holding off on operating doors until the retained messages received on
+	// connecting have settled
+	geo.StartGracePeriod(Config)
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("could not connect to mqtt broker: %v", token.Error())
-	} else {
-		log.Println("Connected to MQTT broker")
+		fatal("Could not connect to mqtt broker", "error", token.Error())
 	}
 
-	messageChan := make(chan mqtt.Message)
+	// listen for incoming messages
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+	run(client, messageChan, signalChannel, reloadChannel)
+}
 
-	// create channels to receive messages
-	for _, car := range Config.Cars {
-		log.Printf("Subscribing to MQTT geofence, latitude, and longitude topics for car %d", car.CarID)
+// create the MQTT client for the configured broker, which (re)subscribes every time it connects and forwards the
+// messages of the car topics to messageChan, and set it as the client that updates are published with
+func newClient(messageChan chan<- mqtt.Message) mqtt.Client {
+	opts := mqttOptions(Config)
+	// handlers run concurrently so that one blocked on the main loop, e.g. during a config reload that waits on the
+	// client to resubscribe, can't deadlock the client; each car's geofence checks are still run in order by its
+	// worker
+	opts.SetOrderMatters(false)
 
-		if token := client.Subscribe(
-			fmt.Sprintf("teslamate/cars/%d/geofence", car.CarID),
-			0,
-			func(client mqtt.Client, message mqtt.Message) {
-				messageChan <- message
-			}); token.Wait() && token.Error() != nil {
-			log.Fatalf("%v", token.Error())
-		}
+	// automatically reconnect if the connection to the broker is lost, unless disabled
+	opts.SetAutoReconnect(Config.MqttAutoReconnects())
+	opts.SetConnectRetry(Config.MqttAutoReconnects())
+	if Config.Global.MqttConnectRetryInterval > 0 {
+		opts.SetConnectRetryInterval(time.Duration(Config.Global.MqttConnectRetryInterval))
+	}
+	if Config.Global.MqttMaxReconnectInterval > 0 {
+		opts.SetMaxReconnectInterval(time.Duration(Config.Global.MqttMaxReconnectInterval))
+	}
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		slog.Warn("Lost connection to MQTT broker", "error", err)
+	})
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		slog.Info("Attempting to reconnect to MQTT broker...")
+	})
 
-		if token := client.Subscribe(
-			fmt.Sprintf("teslamate/cars/%d/latitude", car.CarID),
-			0,
-			func(client mqtt.Client, message mqtt.Message) {
-				messageChan <- message
-			}); token.Wait() && token.Error() != nil {
-			log.Fatalf("%v", token.Error())
-		}
+	// have the broker mark us offline if the connection is lost without disconnecting
+	opts.SetWill(publish.AvailabilityTopic(Config), "offline", publish.CommandQoS(Config), true)
 
-		if token := client.Subscribe(
-			fmt.Sprintf("teslamate/cars/%d/longitude", car.CarID),
-			0,
-			func(client mqtt.Client, message mqtt.Message) {
-				messageChan <- message
-			}); token.Wait() && token.Error() != nil {
-			log.Fatalf("%v", token.Error())
+	// subscriptions are lost when the connection drops, so (re)subscribe every time we connect
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		slog.Info("Connected to MQTT broker")
+		config := currentConfig()
+		publish.Availability(config, true)
+		publish.Automation(config, !geo.Paused())
+		// doors restored from state_file aren't published until they change, so publish each car's home status
+		// as it stands
+		for _, car := range config.Cars {
+			car.Lock()
+			geo.PublishCarHome(config, car)
+			car.Unlock()
 		}
-	}
+		subscribeControl(client, config)
+		if config.Global.HomeAssistantDiscovery {
+			publish.Discovery(config)
+			subscribeDoorCommands(client, config)
+		}
+		subscribeTopics(client, config.Global.MqttTopicPrefix, messageChan)
+		if err := garage.SubscribeRatgdo(client, config); err != nil {
+			fatal("Could not subscribe to ratgdo topics", "error", err)
+		}
+		slog.Info("Topics subscribed, listening for events...")
+	})
 
-	log.Println("Topics subscribed, listening for events...")
+	client := mqtt.NewClient(opts)
+	publish.SetClient(client)
+	return client
+}
 
-	// listen for incoming messages
-	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+// handle messages, config reloads, and timers until signalled, then shut down
+func run(client mqtt.Client, messageChan chan mqtt.Message, signalChannel <-chan os.Signal, reloadChannel <-chan os.Signal) {
+	// receives cars whose lat/lng pair window has expired
+	pairTimeoutChan := make(chan *t.Car)
+
+	// fields received for each car, to warn about cars whose topics never publish
+	received := map[int]map[string]bool{}
+	topicCheck := time.After(topicCheckDelay)
 
 	for {
 		select {
 		case message := <-messageChan:
-			m := strings.Split(message.Topic(), "/")
+			carID, suffix, _ := parseTopic(Config.Global.MqttTopicPrefix, message.Topic())
+			field := Config.Topics.Fields()[suffix]
 			var car *t.Car
 			for _, c := range Config.Cars {
-				if fmt.Sprintf("%d", c.CarID) == m[2] {
+				if c.CarID == carID && c.IsEnabled() {
 					car = c
 				}
 			}
-			switch m[3] {
-			case "geofence":
-				log.Printf("Received geo for car %d: %v", car.CarID, string(message.Payload()))
-			case "latitude":
-				if debug {
-					log.Printf("Received lat for car %d: %v", car.CarID, string(message.Payload()))
+			// the handler filters to configured cars, but a car may have been removed or disabled by a reload since
+			if car == nil {
+				slog.Debug("Ignoring message for unconfigured or disabled car", "topic", message.Topic())
+				break
+			}
+			if received[car.CarID] == nil {
+				received[car.CarID] = map[string]bool{}
+			}
+			received[car.CarID][field] = true
+			switch field {
+			case t.FieldGeofence:
+				slog.Info("Received geo", "car_id", car.CarID, "geofence", string(message.Payload()))
+				if car.TriggerOnGeofenceName != "" {
+					car.Lock()
+					car.CurGeofence = string(message.Payload())
+					car.GeofenceTime = time.Now()
+					if message.Retained() {
+						geo.ReconcileAtHome(Config, car, car.Position())
+						car.Unlock()
+						go saveState(Config)
+						break
+					}
+					position := car.Position()
+					car.Unlock()
+					checkGeoFence(car, position)
 				}
-				car.CurLat, _ = strconv.ParseFloat(string(message.Payload()), 64)
-				go geo.CheckGeoFence(Config, car)
-			case "longitude":
-				if debug {
-					log.Printf("Received long for car %d: %v", car.CarID, string(message.Payload()))
+			case t.FieldLatitude:
+				slog.Debug("Received lat", "car_id", car.CarID, "lat", logPayload(field, message.Payload()))
+				value, err := strconv.ParseFloat(string(message.Payload()), 64)
+				if err != nil {
+					slog.Warn("Unable to parse latitude, ignoring", "car_id", car.CarID, "payload", string(message.Payload()), "error", err)
+					break
 				}
-				car.CurLng, _ = strconv.ParseFloat(string(message.Payload()), 64)
-				go geo.CheckGeoFence(Config, car)
+				car.Lock()
+				car.PendingLats = append(car.PendingLats, t.PendingCoordinate{Value: value, Received: time.Now()})
+				car.PairRetained = car.PairRetained || message.Retained()
+				car.Unlock()
+				handleCoordinateUpdate(car, pairTimeoutChan)
+			case t.FieldLongitude:
+				slog.Debug("Received long", "car_id", car.CarID, "lng", logPayload(field, message.Payload()))
+				value, err := strconv.ParseFloat(string(message.Payload()), 64)
+				if err != nil {
+					slog.Warn("Unable to parse longitude, ignoring", "car_id", car.CarID, "payload", string(message.Payload()), "error", err)
+					break
+				}
+				car.Lock()
+				car.PendingLngs = append(car.PendingLngs, t.PendingCoordinate{Value: value, Received: time.Now()})
+				car.PairRetained = car.PairRetained || message.Retained()
+				car.Unlock()
+				handleCoordinateUpdate(car, pairTimeoutChan)
+			case t.FieldLocation:
+				slog.Debug("Received location", "car_id", car.CarID, "location", logPayload(field, message.Payload()))
+				lat, lng, err := parseLocation(Config.Topics, message.Payload())
+				if err != nil {
+					slog.Warn("Unable to parse location, ignoring", "car_id", car.CarID, "payload", string(message.Payload()), "error", err)
+					break
+				}
+				car.Lock()
+				// both coordinates arrive together, so they're paired with each other right away
+				now := time.Now()
+				car.PendingLats = append(car.PendingLats, t.PendingCoordinate{Value: lat, Received: now})
+				car.PendingLngs = append(car.PendingLngs, t.PendingCoordinate{Value: lng, Received: now})
+				car.PairRetained = car.PairRetained || message.Retained()
+				car.Unlock()
+				handleCoordinateUpdate(car, pairTimeoutChan)
+			case t.FieldSpeed:
+				slog.Debug("Received speed", "car_id", car.CarID, "speed", string(message.Payload()))
+				// teslamate publishes an empty speed when the car isn't driving
+				var value float64
+				if payload := string(message.Payload()); payload != "" {
+					var err error
+					if value, err = strconv.ParseFloat(payload, 64); err != nil {
+						slog.Warn("Unable to parse speed, ignoring", "car_id", car.CarID, "payload", payload, "error", err)
+						break
+					}
+				}
+				car.Lock()
+				car.CurSpeed = value
+				car.SpeedKnown = true
+				car.Unlock()
+			case t.FieldPluggedIn:
+				slog.Debug("Received plugged in", "car_id", car.CarID, "plugged_in", string(message.Payload()))
+				value, err := strconv.ParseBool(string(message.Payload()))
+				if err != nil {
+					slog.Warn("Unable to parse plugged in, ignoring", "car_id", car.CarID, "payload", string(message.Payload()), "error", err)
+					break
+				}
+				car.Lock()
+				car.PluggedIn = value
+				car.Unlock()
+			case t.FieldElevation:
+				slog.Debug("Received elevation", "car_id", car.CarID, "elevation", string(message.Payload()))
+				value, err := strconv.ParseFloat(string(message.Payload()), 64)
+				if err != nil {
+					slog.Warn("Unable to parse elevation, ignoring", "car_id", car.CarID, "payload", string(message.Payload()), "error", err)
+					break
+				}
+				car.Lock()
+				car.CurElevation = value
+				car.ElevationKnown = true
+				car.Unlock()
 			}
 
+		case car := <-pairTimeoutChan:
+			// evaluate any coordinate whose window has expired without its match arriving, then wait on the
+			// next pending coordinate, if any
+			car.Lock()
+			car.PairStartTime = time.Time{}
+			pairCoordinates(car, true)
+			startPairTimer(car, pairTimeoutChan)
+			car.Unlock()
+
+		case <-topicCheck:
+			checkReceivedTopics(Config, received)
+
+		case <-reloadChannel:
+			slog.Info("Received hangup signal, reloading config...")
+			reloadConfig(client, messageChan)
+
 		case <-signalChannel:
-			log.Println("Received interrupt signal, shutting down...")
-			client.Disconnect(250)
-			time.Sleep(250 * time.Millisecond)
+			slog.Info("Received interrupt signal, shutting down...")
+			shutdown(client)
 			return
 
 		}
 	}
 }
 
-// check for env vars and validate that a myq_email and myq_pass exists
-func checkEnvVars() {
-	// override config with env vars if present
-	if value, exists := os.LookupEnv("MYQ_EMAIL"); exists {
-		Config.Global.MyQEmail = value
+// build the tls config for the mqtt broker connection, trusting the configured CA cert if provided and presenting
+// the configured client cert for mutual tls
+func mqttTLSConfig(config t.ConfigStruct) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Global.MqttTLSInsecure}
+	if config.Global.MqttTLSCACert != "" {
+		caCert, err := os.ReadFile(config.Global.MqttTLSCACert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca cert: %v", err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificates found in %s", config.Global.MqttTLSCACert)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	if config.Global.MqttTLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.Global.MqttTLSClientCert, config.Global.MqttTLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// returns the options for connecting to the configured mqtt broker or brokers: the address, tls, websockets,
+// client id, protocol version, and credentials
+func mqttOptions(config t.ConfigStruct) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	scheme := "tcp"
+	if config.Global.MqttUseTLS {
+		scheme = "ssl"
+		tlsConfig, err := mqttTLSConfig(config)
+		if err != nil {
+			fatal("Could not configure tls for mqtt broker", "error", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
 	}
-	if value, exists := os.LookupEnv("MYQ_PASS"); exists {
-		Config.Global.MyQPass = value
+	var path string
+	if config.Global.MqttUseWebsocket {
+		// websocket connections go through HTTP_PROXY/HTTPS_PROXY/NO_PROXY; tcp connections only support a
+		// socks5 proxy in all_proxy
+		scheme = map[string]string{"tcp": "ws", "ssl": "wss"}[scheme]
+		path = "/" + strings.TrimPrefix(config.Global.MqttWebsocketPath, "/")
+		opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: http.ProxyFromEnvironment})
 	}
-	if Config.Global.MyQEmail == "" || Config.Global.MyQPass == "" {
-		log.Fatal("MYQ_EMAIL and MYQ_PASS must be defined in the config file or as env vars")
+	// paho tries the brokers in order each time it connects, using the first that accepts the connection
+	brokers := config.Global.MqttBrokers
+	if len(brokers) == 0 {
+		brokers = []string{net.JoinHostPort(config.Global.MqttHost, strconv.Itoa(config.Global.MqttPort))}
 	}
+	for _, broker := range brokers {
+		opts.AddBroker(fmt.Sprintf("%s://%s%s", scheme, broker, path))
+	}
+	opts.SetClientID(config.Global.MqttClientID)
+	if config.Global.MqttProtocolVersion != 0 {
+		opts.SetProtocolVersion(uint(config.Global.MqttProtocolVersion))
+	}
+	if config.Global.MqttUsername != "" {
+		opts.SetUsername(config.Global.MqttUsername)
+		opts.SetPassword(config.Global.MqttPassword)
+	}
+	return opts
+}
+
+// subscribe to all of teslamate's car topics under the prefix with a single wildcard subscription, and forward
+// the messages of configured, enabled cars on the topics that fields are read from to messageChan
+func subscribeTopics(client mqtt.Client, prefix string, messageChan chan<- mqtt.Message) {
+	topic := prefix + "/+/+"
+	slog.Info("Subscribing to MQTT topic", "topic", topic)
+	if token := client.Subscribe(
+		topic,
+		publish.QoS(currentConfig()),
+		func(client mqtt.Client, message mqtt.Message) {
+			traceMessage(message)
+			config := currentConfig()
+			carID, suffix, ok := parseTopic(config.Global.MqttTopicPrefix, message.Topic())
+			if _, read := config.Topics.Fields()[suffix]; !ok || !read {
+				return
+			}
+			for _, car := range config.Cars {
+				if car.CarID == carID && car.IsEnabled() {
+					messageChan <- message
+					return
+				}
+			}
+		}); token.Wait() && token.Error() != nil {
+		fatal("Could not subscribe to topic", "topic", topic, "error", token.Error())
+	}
+}
+
+// subscribe to the command topics of the home assistant covers, operating the garage door for OPEN and CLOSE
+func subscribeDoorCommands(client mqtt.Client, config t.ConfigStruct) {
+	topic := publish.DoorCommandTopic(config)
+	slog.Info("Subscribing to MQTT topic", "topic", topic)
+	if token := client.Subscribe(
+		topic,
+		publish.CommandQoS(config),
+		func(client mqtt.Client, message mqtt.Message) {
+			traceMessage(message)
+			config := currentConfig()
+			serial, ok := publish.DoorCommandSerial(config, message.Topic())
+			if !ok {
+				return
+			}
+			action := map[string]string{"OPEN": garage.ActionOpen, "CLOSE": garage.ActionClose}[string(message.Payload())]
+			if action == "" {
+				slog.Warn("Ignoring unsupported door command", "door_serial", serial, "payload", string(message.Payload()))
+				return
+			}
+			for _, car := range config.Cars {
+				for _, door := range car.GarageDoors {
+					if door.MyQSerial != serial {
+						continue
+					}
+					slog.Info("Received door command from MQTT", "car_id", car.CarID, "door_serial", serial, "action", action)
+					inFlight.Add(1)
+					pendingOperations.Add(1)
+					if _, err := geo.OperateGarageDoor(appCtx, config, car, door, action); errors.Is(err, geo.ErrDoorBusy) {
+						slog.Warn("Ignoring door command, garage door is already being operated", "car_id", car.CarID, "door_serial", serial, "action", action)
+					} else if err != nil {
+						slog.Error("Unable to operate garage door", "car_id", car.CarID, "door_serial", serial, "action", action, "error", err)
+					}
+					pendingOperations.Add(-1)
+					inFlight.Done()
+					return
+				}
+			}
+			slog.Warn("Ignoring command for unconfigured garage door", "door_serial", serial)
+		}); token.Wait() && token.Error() != nil {
+		fatal("Could not subscribe to topic", "topic", topic, "error", token.Error())
+	}
+}
+
+// subscribe to the control topic, pausing geofence automation on false (or OFF) and resuming it on true (or ON)
+func subscribeControl(client mqtt.Client, config t.ConfigStruct) {
+	topic := publish.ControlTopic(config)
+	slog.Info("Subscribing to MQTT topic", "topic", topic)
+	if token := client.Subscribe(
+		topic,
+		publish.CommandQoS(config),
+		func(client mqtt.Client, message mqtt.Message) {
+			traceMessage(message)
+			var enabled bool
+			switch strings.ToLower(strings.TrimSpace(string(message.Payload()))) {
+			case "true", "on":
+				enabled = true
+			case "false", "off":
+				enabled = false
+			default:
+				slog.Warn("Ignoring unsupported control payload, expected true or false", "topic", message.Topic(), "payload", string(message.Payload()))
+				return
+			}
+			if enabled == !geo.Paused() {
+				return
+			}
+			if enabled {
+				slog.Info("Resuming geofence automation")
+			} else {
+				slog.Info("Pausing geofence automation, garage doors won't be operated until it's resumed")
+			}
+			geo.SetPaused(currentConfig(), !enabled)
+		}); token.Wait() && token.Error() != nil {
+		fatal("Could not subscribe to topic", "topic", topic, "error", token.Error())
+	}
+}
+
+// unsubscribe from the wildcard subscription under the prefix, e.g. when the prefix changes
+func unsubscribeTopics(client mqtt.Client, prefix string) {
+	topic := prefix + "/+/+"
+	slog.Info("Unsubscribing from MQTT topic", "topic", topic)
+	if token := client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+		slog.Error("Could not unsubscribe from topic", "topic", topic, "error", token.Error())
+	}
+}
+
+// parse a topic of the form <prefix>/<car id>/<field>; ok is false if the topic isn't in that form
+func parseTopic(prefix string, topic string) (carID int, field string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(topic, prefix+"/"), "/")
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	carID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+	return carID, parts[1], true
+}
+
+// returns the teslamate fields the car's geofences depend on
+func requiredFields(config t.ConfigStruct, car *t.Car) []string {
+	if car.TriggerOnGeofenceName != "" {
+		return []string{t.FieldGeofence}
+	} else if config.Topics.Location != "" {
+		return []string{t.FieldLocation}
+	}
+	return []string{t.FieldLatitude, t.FieldLongitude}
+}
+
+// warn about each car missing a field its geofences depend on; a car with no messages at all may just not have
+// published yet, e.g. if teslamate was set up after it last drove, or its teslamate_car_id may be wrong, while
+// a car with other fields but not these means teslamate isn't publishing them and the door will never operate
+func checkReceivedTopics(config t.ConfigStruct, received map[int]map[string]bool) {
+	for _, car := range config.Cars {
+		if !car.IsEnabled() {
+			continue
+		}
+		fields := received[car.CarID]
+		if len(fields) == 0 {
+			slog.Warn("No messages received for car yet; check that teslamate_car_id and mqtt_topic_prefix match TeslaMate",
+				"car_id", car.CarID, "topic", fmt.Sprintf("%s/%d/+", config.Global.MqttTopicPrefix, car.CarID), "waited", topicCheckDelay)
+			continue
+		}
+		for _, field := range requiredFields(config, car) {
+			if !fields[field] {
+				slog.Warn("Receiving messages for car, but not a topic its geofences need; TeslaMate may not publish it, so the door won't be operated",
+					"car_id", car.CarID, "topic", fmt.Sprintf("%s/%d/%s", config.Global.MqttTopicPrefix, car.CarID, config.Topics.Topic(field)), "waited", topicCheckDelay)
+			}
+		}
+	}
+}
+
+// evaluate the geofence once both a new latitude and longitude have been received for a car, so that
+// a fresh coordinate is never paired with a stale one; if the matching coordinate doesn't arrive within
+// coordinatePairWindow (e.g. the car moved along only one axis), evaluate with the latest known values
+func handleCoordinateUpdate(car *t.Car, pairTimeoutChan chan<- *t.Car) {
+	car.Lock()
+	defer car.Unlock()
+	if car.TriggerOnGeofenceName != "" {
+		// coordinates aren't used when triggering on teslamate geofence names, so only keep the latest
+		for _, lat := range car.PendingLats {
+			car.CurLat, car.LatTime = lat.Value, lat.Received
+		}
+		for _, lng := range car.PendingLngs {
+			car.CurLng, car.LngTime = lng.Value, lng.Received
+		}
+		car.PendingLats, car.PendingLngs = nil, nil
+		car.PairRetained = false
+		return
+	}
+	pairCoordinates(car, false)
+	startPairTimer(car, pairTimeoutChan)
+}
+
+// pair the car's pending latitudes and longitudes oldest first, evaluating each position; since messages can be
+// delivered out of order, a second latitude may arrive before the first longitude, and pairing in order keeps
+// each with the other half of its own position. a coordinate received more than coordinatePairWindow before its
+// would-be match, or, if expire is set, one that's been waiting that long, is evaluated on its own with the
+// latest known value of the other coordinate. caller must hold the car's lock
+func pairCoordinates(car *t.Car, expire bool) {
+	for {
+		var lat, lng *t.PendingCoordinate
+		if len(car.PendingLats) > 0 {
+			lat = &car.PendingLats[0]
+		}
+		if len(car.PendingLngs) > 0 {
+			lng = &car.PendingLngs[0]
+		}
+		switch {
+		case lat != nil && lng != nil && lng.Received.Sub(lat.Received) <= coordinatePairWindow && lat.Received.Sub(lng.Received) <= coordinatePairWindow:
+			car.CurLat, car.LatTime = lat.Value, lat.Received
+			car.CurLng, car.LngTime = lng.Value, lng.Received
+			car.PendingLats, car.PendingLngs = car.PendingLats[1:], car.PendingLngs[1:]
+		case lat != nil && (lng != nil && lat.Received.Before(lng.Received) || lng == nil && expire && time.Since(lat.Received) >= coordinatePairWindow):
+			car.CurLat, car.LatTime = lat.Value, lat.Received
+			car.PendingLats = car.PendingLats[1:]
+		case lng != nil && (lat != nil || expire && time.Since(lng.Received) >= coordinatePairWindow):
+			car.CurLng, car.LngTime = lng.Value, lng.Received
+			car.PendingLngs = car.PendingLngs[1:]
+		default:
+			return
+		}
+		evaluateCoordinates(car, car.Position())
+	}
+}
+
+// start a timer to evaluate the car's oldest pending coordinate once its pair window expires, unless one is
+// already running or nothing is pending; caller must hold the car's lock
+func startPairTimer(car *t.Car, pairTimeoutChan chan<- *t.Car) {
+	if !car.PairStartTime.IsZero() || len(car.PendingLats)+len(car.PendingLngs) == 0 {
+		return
+	}
+	oldest := time.Now()
+	for _, pending := range [][]t.PendingCoordinate{car.PendingLats, car.PendingLngs} {
+		if len(pending) > 0 && pending[0].Received.Before(oldest) {
+			oldest = pending[0].Received
+		}
+	}
+	car.PairStartTime = time.Now()
+	time.AfterFunc(time.Until(oldest.Add(coordinatePairWindow)), func() {
+		pairTimeoutChan <- car
+	})
+}
+
+// queue a check of the car's geofences at position, the position just paired from its pending coordinates, or
+// only reconcile whether the car is home if the pair was retained; caller must hold the car's lock
+func evaluateCoordinates(car *t.Car, position t.Position) {
+	if car.PairRetained {
+		// a retained position may be from before the app was down or disconnected, so it only reconciles
+		// whether the car is home
+		car.PairRetained = false
+		geo.ReconcileAtHome(Config, car, position)
+		go saveState(Config)
+		return
+	}
+	checkGeoFence(car, position)
+}
+
+// a geofence check waiting for its car's worker, with a copy of the position that triggered it
+type carCheck struct {
+	config   t.ConfigStruct
+	car      *t.Car
+	position t.Position
+}
+
+// queue of geofence checks for each car, keyed by teslamate car id; only used from the main loop
+var carQueues = map[int]chan carCheck{}
+
+// queue a check of the car's geofences at position for the car's worker, tracking the check as an in-flight
+// operation so that shutdown can wait for any door it operates. each car's checks run one at a time in the order
+// they're queued, so they can't race each other, while cars are checked independently. each check evaluates the
+// position it was queued with, even if newer positions have been received by the time it runs. if the car's queue
+// is full, e.g. while a slow MyQ call holds up its worker, the check and its position are dropped
+func checkGeoFence(car *t.Car, position t.Position) {
+	queue, ok := carQueues[car.CarID]
+	if !ok {
+		queue = make(chan carCheck, carQueueSize)
+		carQueues[car.CarID] = queue
+		go runCarChecks(queue)
+	}
+	inFlight.Add(1)
+	pendingOperations.Add(1)
+	select {
+	case queue <- carCheck{config: Config, car: car, position: position}:
+	default:
+		pendingOperations.Add(-1)
+		inFlight.Done()
+		slog.Debug("Dropping geofence check, car's queue is full", "car_id", car.CarID, "queued", carQueueSize)
+	}
+}
+
+// run each queued geofence check for a car in order; checks still queued at shutdown are skipped
+func runCarChecks(queue <-chan carCheck) {
+	for check := range queue {
+		if appCtx.Err() == nil {
+			geo.CheckGeoFence(appCtx, check.config, check.car, check.position)
+			saveState(check.config)
+		}
+		pendingOperations.Add(-1)
+		inFlight.Done()
+	}
+}
+
+// stop receiving messages, cancel waiting for doors that are being operated, and wait up to shutdownTimeout for
+// in-flight geofence checks and door commands to return (e.g. from a MyQ call that can't be cancelled) before
+// disconnecting from the broker
+func shutdown(client mqtt.Client) {
+	unsubscribeTopics(client, Config.Global.MqttTopicPrefix)
+	client.Unsubscribe(publish.ControlTopic(Config)).Wait()
+	if Config.Global.HomeAssistantDiscovery {
+		client.Unsubscribe(publish.DoorCommandTopic(Config)).Wait()
+	}
+	cancelApp()
+
+	if pending := pendingOperations.Load(); pending > 0 {
+		slog.Info("Waiting for in-flight garage door operations to stop", "pending", pending, "timeout", shutdownTimeout)
+		done := make(chan struct{})
+		go func() {
+			inFlight.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			slog.Info("In-flight garage door operations stopped")
+		case <-time.After(shutdownTimeout):
+			slog.Warn("Timed out waiting for garage door operations to stop", "pending", pendingOperations.Load())
+		}
+	}
+
+	// the last will isn't sent on a clean disconnect, so mark us offline first
+	publish.Availability(Config, false)
+	client.Disconnect(250)
+}
+
+// configure the default logger from the log_level and log_format config; DEBUG=true forces the debug level
+func configureLogger() {
+	level := slog.LevelInfo
+	if Config.Global.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(Config.Global.LogLevel)); err != nil {
+			fatal("Invalid log_level, must be one of debug, info, warn, or error", "log_level", Config.Global.LogLevel)
+		}
+	}
+	if Config.Debug {
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(Config.Global.LogFormat) {
+	case "", "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, opts)))
+	default:
+		fatal("Invalid log_format, must be one of text or json", "log_format", Config.Global.LogFormat)
+	}
+}
+
+// wrap handler so that shutdown waits for its requests, which may be operating a garage door, to finish
+func trackInFlight(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		pendingOperations.Add(1)
+		defer func() {
+			pendingOperations.Add(-1)
+			inFlight.Done()
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// log an error and exit
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
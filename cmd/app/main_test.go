@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+
+	"myq-teslamate-geofence/internal/garage"
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// config for a car whose door is operated by its coordinates and one whose door is operated by its teslamate
+// geofence, both through ratgdo; %d is the broker's port
+const endToEndConfig = `
+global:
+  mqtt_host: 127.0.0.1
+  mqtt_port: %d
+  mqtt_client_id: myq-teslamate-geofence-test
+  door_action_timeout: 10s
+  locations:
+    home:
+      lat: 48.858195
+      lng: 2.294689
+cars:
+  - teslamate_car_id: 1
+    controller: ratgdo
+    garage_doors:
+      - myq_serial: garage
+        garage_close_geofence:
+          location: home
+          geo_radius: 100m
+        garage_open_geofence:
+          location: home
+          geo_radius: 50m
+  - teslamate_car_id: 2
+    controller: ratgdo
+    trigger_on_geofence_name: Home
+    garage_doors:
+      - myq_serial: gate
+`
+
+// how long to wait for the app to react to a message
+const endToEndTimeout = 5 * time.Second
+
+// start an mqtt broker on a free local port, closing it when the test finishes; returns the port
+func startBroker(test *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("could not find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	server := broker.New(&broker.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		test.Fatalf("could not allow connections to broker: %v", err)
+	}
+	if err := server.AddListener(listeners.NewTCP("tcp", fmt.Sprintf("127.0.0.1:%d", port), nil)); err != nil {
+		test.Fatalf("could not listen on port %d: %v", port, err)
+	}
+	if err := server.Serve(); err != nil {
+		test.Fatalf("could not start broker: %v", err)
+	}
+	test.Cleanup(func() { server.Close() })
+	return port
+}
+
+// connect a client to the broker on port, disconnecting it when the test finishes
+func connectClient(test *testing.T, port int, clientID string) mqtt.Client {
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://127.0.0.1:%d", port)).SetClientID(clientID)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		test.Fatalf("could not connect %s to broker: %v", clientID, token.Error())
+	}
+	test.Cleanup(func() { client.Disconnect(250) })
+	return client
+}
+
+// a ratgdo device for each door that records the commands it receives, and reports the door reaching the
+// resulting state on its status topic
+type fakeRatgdo struct {
+	sync.Mutex
+	commands []string // <serial> <action>
+}
+
+// connect the fake ratgdo devices, reporting each door's initial state as a retained status
+func startRatgdo(test *testing.T, port int, states map[string]string) *fakeRatgdo {
+	ratgdo := &fakeRatgdo{}
+	client := connectClient(test, port, "ratgdo")
+	for serial, state := range states {
+		client.Publish(fmt.Sprintf("ratgdo/%s/status/door", serial), 1, true, state).Wait()
+	}
+	token := client.Subscribe("ratgdo/+/command/door", 1, func(client mqtt.Client, message mqtt.Message) {
+		serial := strings.Split(message.Topic(), "/")[1]
+		action := string(message.Payload())
+		ratgdo.Lock()
+		ratgdo.commands = append(ratgdo.commands, serial+" "+action)
+		ratgdo.Unlock()
+		// only the resulting state is reported, since the app handles messages concurrently and could see a
+		// transitional state after it
+		state := map[string]string{garage.ActionOpen: garage.StateOpen, garage.ActionClose: garage.StateClosed}[action]
+		client.Publish(fmt.Sprintf("ratgdo/%s/status/door", serial), 1, true, state)
+	})
+	if token.Wait() && token.Error() != nil {
+		test.Fatalf("could not subscribe to ratgdo commands: %v", token.Error())
+	}
+	return ratgdo
+}
+
+// returns the commands received so far
+func (r *fakeRatgdo) received() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+// wait for the fake ratgdo devices to have received exactly the commands in want, failing the test if they
+// haven't within endToEndTimeout
+func (r *fakeRatgdo) await(test *testing.T, step string, want ...string) {
+	test.Helper()
+	deadline := time.Now().Add(endToEndTimeout)
+	for time.Now().Before(deadline) && !reflect.DeepEqual(r.received(), want) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := r.received(); !reflect.DeepEqual(got, want) {
+		test.Fatalf("%s: ratgdo commands = %q, want %q", step, got, want)
+	}
+}
+
+// wait for the app to finish checking the geofences of each car, failing the test if it doesn't within
+// endToEndTimeout
+func awaitChecks(test *testing.T, step string) {
+	test.Helper()
+	deadline := time.Now().Add(endToEndTimeout)
+	for time.Now().Before(deadline) {
+		initialized := true
+		for _, car := range Config.Cars {
+			car.Lock()
+			for _, door := range car.GarageDoors {
+				initialized = initialized && door.Initialized && !door.OpLock
+			}
+			car.Unlock()
+		}
+		if initialized && pendingOperations.Load() == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Fatalf("%s: geofences weren't checked within %v", step, endToEndTimeout)
+}
+
+func TestEndToEnd(test *testing.T) {
+	port := startBroker(test)
+	path := filepath.Join(test.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(endToEndConfig, port)), 0o600); err != nil {
+		test.Fatal(err)
+	}
+	if err := loadConfig(path, &Config); err != nil {
+		test.Fatalf("could not load config: %v", err)
+	}
+	ratgdo := startRatgdo(test, port, map[string]string{"garage": garage.StateOpen, "gate": garage.StateOpen})
+
+	messageChan := make(chan mqtt.Message)
+	client := newClient(messageChan)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		test.Fatalf("could not connect app to broker: %v", token.Error())
+	}
+	signalChannel, reloadChannel := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		run(client, messageChan, signalChannel, reloadChannel)
+		close(done)
+	}()
+
+	teslamate := connectClient(test, port, "teslamate")
+	moveTo := func(lat float64, lng float64, retained bool) {
+		teslamate.Publish("teslamate/cars/1/latitude", 1, retained, fmt.Sprint(lat)).Wait()
+		teslamate.Publish("teslamate/cars/1/longitude", 1, retained, fmt.Sprint(lng)).Wait()
+	}
+	enter := func(geofence string, retained bool) {
+		teslamate.Publish("teslamate/cars/2/geofence", 1, retained, geofence).Wait()
+	}
+
+	// the first position of each car is retained, as teslamate does, so that it's received once the app has
+	// subscribed, and only determines whether the car is home
+	moveTo(48.858195, 2.294689, true)
+	enter("Home", true)
+	awaitChecks(test, "first position")
+	ratgdo.await(test, "first position")
+
+	// staying home doesn't operate the doors
+	moveTo(48.858200, 2.294700, false)
+	enter("Home", false)
+	awaitChecks(test, "staying home")
+	ratgdo.await(test, "staying home")
+
+	// leaving closes each car's door
+	moveTo(48.868195, 2.294689, false)
+	ratgdo.await(test, "leaving", "garage close")
+	enter("", false)
+	ratgdo.await(test, "leaving", "garage close", "gate close")
+
+	// arriving opens them again
+	moveTo(48.858195, 2.294689, false)
+	ratgdo.await(test, "arriving", "garage close", "gate close", "garage open")
+	enter("Home", false)
+	ratgdo.await(test, "arriving", "garage close", "gate close", "garage open", "gate open")
+	awaitChecks(test, "arriving")
+
+	for _, car := range Config.Cars {
+		car.Lock()
+		for _, door := range car.GarageDoors {
+			if !door.AtHome {
+				test.Errorf("car %d, door %s: AtHome = false after arriving, want true", car.CarID, door.MyQSerial)
+			}
+		}
+		car.Unlock()
+	}
+
+	signalChannel <- os.Interrupt
+	select {
+	case <-done:
+	case <-time.After(endToEndTimeout):
+		test.Fatal("app didn't shut down")
+	}
+}
+
+func TestPairCoordinatesQueuesEachPosition(test *testing.T) {
+	car := &t.Car{CarID: 1, CarState: &t.CarState{}}
+	// queue checks without a worker, so they can be inspected
+	queue := make(chan carCheck, carQueueSize)
+	carQueues[car.CarID] = queue
+	test.Cleanup(func() { delete(carQueues, car.CarID) })
+
+	// the second latitude arrives before the first longitude, so the car has moved on by the time the first
+	// position's check runs
+	now := time.Now()
+	car.Lock()
+	car.PendingLats = []t.PendingCoordinate{{Value: 48.1, Received: now}, {Value: 48.2, Received: now.Add(5 * time.Millisecond)}}
+	car.PendingLngs = []t.PendingCoordinate{{Value: 2.1, Received: now.Add(10 * time.Millisecond)}, {Value: 2.2, Received: now.Add(15 * time.Millisecond)}}
+	pairCoordinates(car, false)
+	car.Unlock()
+
+	for _, want := range []t.Point{{Lat: 48.1, Lng: 2.1}, {Lat: 48.2, Lng: 2.2}} {
+		select {
+		case check := <-queue:
+			if check.position.Point != want {
+				test.Errorf("queued position = %v, want %v", check.position.Point, want)
+			}
+			pendingOperations.Add(-1)
+			inFlight.Done()
+		default:
+			test.Fatalf("no check queued for position %v", want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	geo "myq-teslamate-geofence/internal/geo"
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// a position read from a replay track
+type trackPoint struct {
+	lat, lng     float64
+	elevation    float64
+	hasElevation bool
+}
+
+// feed each point of the track through the geofence logic for the car in dry run mode, printing each time one
+// of the car's garage doors would change between home and away; cooldowns, dwell times, delays, and webhooks are disabled
+// so that the track can be replayed faster than it was driven
+func replay(config t.ConfigStruct, path string, carID int, interval time.Duration) error {
+	points, err := readTrack(path)
+	if err != nil {
+		return err
+	}
+
+	config.DryRun = true
+	config.Webhooks = nil
+	config.Global.OpCooldown = 0
+	config.Global.DwellTime = 0
+	var car *t.Car
+	for _, c := range config.Cars {
+		if car == nil && (carID == 0 || c.CarID == carID) {
+			car = c
+		}
+	}
+	if car == nil {
+		return fmt.Errorf("car %d isn't configured", carID)
+	}
+	if car.TriggerOnGeofenceName != "" {
+		return fmt.Errorf("car %d uses trigger_on_geofence_name, which can't be replayed from coordinates", car.CarID)
+	}
+	car.OpenCooldown, car.CloseCooldown, car.DwellTime = nil, nil, nil
+	car.OpenDelay, car.CloseDelay = 0, 0
+
+	fmt.Printf("Replaying %d points from %s for car %d\n", len(points), path, car.CarID)
+	for i, point := range points {
+		car.Lock()
+		before := map[string]bool{}
+		for _, door := range car.GarageDoors {
+			before[door.MyQSerial] = door.AtHome
+		}
+		car.CurLat, car.CurLng = point.lat, point.lng
+		if point.hasElevation {
+			car.CurElevation, car.ElevationKnown = point.elevation, true
+		}
+		position := car.Position()
+		car.Unlock()
+
+		geo.CheckGeoFence(context.Background(), config, car, position)
+
+		car.Lock()
+		for _, door := range car.GarageDoors {
+			if i == 0 {
+				fmt.Printf("point %d (%f, %f): door %s starts %s\n", i+1, point.lat, point.lng, door.MyQSerial, homeOrAway(door.AtHome))
+			} else if door.AtHome != before[door.MyQSerial] {
+				fmt.Printf("point %d (%f, %f): door %s is now %s\n", i+1, point.lat, point.lng, door.MyQSerial, homeOrAway(door.AtHome))
+			}
+		}
+		car.Unlock()
+
+		time.Sleep(interval)
+	}
+	return nil
+}
+
+func homeOrAway(atHome bool) string {
+	if atHome {
+		return "home"
+	}
+	return "away"
+}
+
+// read a track from a gpx file, or a csv file of lat,lng[,elevation] rows with an optional header
+func readTrack(path string) ([]trackPoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open track: %v", err)
+	}
+	defer file.Close()
+
+	var points []trackPoint
+	if strings.EqualFold(filepath.Ext(path), ".gpx") {
+		points, err = readGPX(file)
+	} else {
+		points, err = readCSV(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read track: %v", err)
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no points found in track %s", path)
+	}
+	return points, nil
+}
+
+// read the track points, route points, and waypoints of a gpx file, in order
+func readGPX(r io.Reader) ([]trackPoint, error) {
+	var points []trackPoint
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return points, nil
+		} else if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || (start.Name.Local != "trkpt" && start.Name.Local != "rtept" && start.Name.Local != "wpt") {
+			continue
+		}
+		var gpxPoint struct {
+			Lat float64  `xml:"lat,attr"`
+			Lng float64  `xml:"lon,attr"`
+			Ele *float64 `xml:"ele"`
+		}
+		if err := decoder.DecodeElement(&gpxPoint, &start); err != nil {
+			return nil, err
+		}
+		point := trackPoint{lat: gpxPoint.Lat, lng: gpxPoint.Lng}
+		if gpxPoint.Ele != nil {
+			point.elevation, point.hasElevation = *gpxPoint.Ele, true
+		}
+		points = append(points, point)
+	}
+}
+
+// read lat,lng[,elevation] rows, skipping a header row if present
+func readCSV(r io.Reader) ([]trackPoint, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var points []trackPoint
+	for i, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("line %d: expected lat,lng[,elevation]", i+1)
+		}
+		lat, errLat := strconv.ParseFloat(row[0], 64)
+		lng, errLng := strconv.ParseFloat(row[1], 64)
+		if errLat != nil || errLng != nil {
+			if i == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("line %d: invalid lat or lng", i+1)
+		}
+		point := trackPoint{lat: lat, lng: lng}
+		if len(row) > 2 && row[2] != "" {
+			if point.elevation, err = strconv.ParseFloat(row[2], 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid elevation", i+1)
+			}
+			point.hasElevation = true
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
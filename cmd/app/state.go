@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// runtime state of a garage door that's persisted to state_file so it survives restarts
+type persistedDoor struct {
+	AtHome         bool      `json:"at_home"`
+	LastActionTime time.Time `json:"last_action_time"`
+	LastAction     string    `json:"last_action,omitempty"`
+}
+
+// contents of state_file, keyed by teslamate car id and then by door serial
+type persistedState struct {
+	Cars map[int]map[string]persistedDoor `json:"cars"`
+}
+
+var (
+	stateLock sync.Mutex // serializes writes to state_file
+	lastSaved []byte     // last state written, to skip writes when nothing has changed
+)
+
+// restore the state of each garage door from state_file, if set; doors without saved state, or all doors if
+// the file is missing or can't be read, are initialized from the car's first position as usual
+func loadState(config t.ConfigStruct) {
+	path := config.Global.StateFile
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		slog.Info("No saved state found, initializing from first positions", "state_file", path)
+		return
+	} else if err != nil {
+		slog.Warn("Could not read saved state, initializing from first positions", "state_file", path, "error", err)
+		return
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		slog.Warn("Could not parse saved state, initializing from first positions", "state_file", path, "error", err)
+		return
+	}
+
+	for _, car := range config.Cars {
+		car.Lock()
+		for _, door := range car.GarageDoors {
+			saved, ok := state.Cars[car.CarID][door.MyQSerial]
+			if !ok {
+				continue
+			}
+			door.AtHome = saved.AtHome
+			door.LastActionTime = saved.LastActionTime
+			door.LastAction = saved.LastAction
+			door.Initialized = true
+			slog.Info("Restored garage door state", "car_id", car.CarID, "door_serial", door.MyQSerial, "at_home", door.AtHome,
+				"last_action", door.LastAction, "last_action_time", door.LastActionTime)
+		}
+		car.Unlock()
+	}
+	lastSaved = data
+}
+
+// write the state of each initialized garage door to state_file, if set and the state has changed since it was
+// last written; the file is replaced atomically so a crash mid-write doesn't corrupt it
+func saveState(config t.ConfigStruct) {
+	path := config.Global.StateFile
+	if path == "" {
+		return
+	}
+	state := persistedState{Cars: map[int]map[string]persistedDoor{}}
+	for _, car := range config.Cars {
+		car.Lock()
+		for _, door := range car.GarageDoors {
+			if !door.Initialized {
+				continue
+			}
+			if state.Cars[car.CarID] == nil {
+				state.Cars[car.CarID] = map[string]persistedDoor{}
+			}
+			state.Cars[car.CarID][door.MyQSerial] = persistedDoor{
+				AtHome:         door.AtHome,
+				LastActionTime: door.LastActionTime,
+				LastAction:     door.LastAction,
+			}
+		}
+		car.Unlock()
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		slog.Error("Could not encode state", "error", err)
+		return
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if bytes.Equal(data, lastSaved) {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		slog.Error("Could not save state", "state_file", path, "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		slog.Error("Could not save state", "state_file", path, "error", err)
+		return
+	}
+	lastSaved = data
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// read the latitude and longitude from a json location message, e.g. {"latitude": 48.85, "longitude": 2.29},
+// at the configured paths
+func parseLocation(topics t.Topics, payload []byte) (lat float64, lng float64, err error) {
+	var location any
+	if err := json.Unmarshal(payload, &location); err != nil {
+		return 0, 0, err
+	}
+	latPath, lngPath := topics.LocationPaths()
+	if lat, err = jsonNumber(location, latPath); err != nil {
+		return 0, 0, err
+	}
+	if lng, err = jsonNumber(location, lngPath); err != nil {
+		return 0, 0, err
+	}
+	return lat, lng, nil
+}
+
+// returns the number at the dot separated path in the decoded json value; numbers encoded as strings are
+// accepted, since some sources publish them that way
+func jsonNumber(value any, path string) (float64, error) {
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("%s: not found", path)
+		}
+		if value, ok = object[key]; !ok {
+			return 0, fmt.Errorf("%s: not found", path)
+		}
+	}
+	switch number := value.(type) {
+	case float64:
+		return number, nil
+	case string:
+		parsed, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", path, err)
+		}
+		return parsed, nil
+	}
+	return 0, fmt.Errorf("%s: not a number", path)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// log each message received from the broker when --trace-mqtt is set, including messages that are then ignored,
+// to diagnose topics that don't match what the app expects
+func traceMessage(message mqtt.Message) {
+	if !TraceMqtt {
+		return
+	}
+	config := currentConfig()
+	_, suffix, _ := parseTopic(config.Global.MqttTopicPrefix, message.Topic())
+	field := config.Topics.Fields()[suffix]
+	slog.Info("Received MQTT message", "topic", message.Topic(), "payload", logPayload(field, message.Payload()),
+		"retained", message.Retained(), "qos", message.Qos())
+}
+
+// returns the payload of a message for logging; latitudes and longitudes are rounded to --log-precision decimal
+// places if set, so that logs don't reveal exact locations. a location message is logged as only its rounded
+// coordinates, since anything else in it, such as a heading, could give the location away
+func logPayload(field string, payload []byte) string {
+	if LogPrecision < 0 {
+		return string(payload)
+	}
+	switch field {
+	case t.FieldLatitude, t.FieldLongitude:
+		value, err := strconv.ParseFloat(string(payload), 64)
+		if err != nil {
+			return string(payload)
+		}
+		return strconv.FormatFloat(value, 'f', LogPrecision, 64)
+	case t.FieldLocation:
+		lat, lng, err := parseLocation(currentConfig().Topics, payload)
+		if err != nil {
+			return "<redacted>"
+		}
+		return strconv.FormatFloat(lat, 'f', LogPrecision, 64) + "," + strconv.FormatFloat(lng, 'f', LogPrecision, 64)
+	}
+	return string(payload)
+}
@@ -1,15 +1,27 @@
 module myq-teslamate-geofence
 
-go 1.19
+go 1.21
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/joeshaw/myq v0.0.0-20221122173250-4d1216b9fc87
+	github.com/mochi-mqtt/server/v2 v2.4.6
+	github.com/prometheus/client_golang v1.12.2
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/gorilla/websocket v1.4.2 // indirect
-	golang.org/x/net v0.0.0-20210917221730-978cfadd31cf // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
 )
@@ -0,0 +1,72 @@
+package garage
+
+import (
+	"myq-teslamate-geofence/internal/metrics"
+	"myq-teslamate-geofence/internal/publish"
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// garage door controller types that a car can be configured to use
+const (
+	ControllerMyQ    = "myq"
+	ControllerRatgdo = "ratgdo"
+)
+
+// garage door actions and states shared by all controllers
+const (
+	ActionOpen  = "open"
+	ActionClose = "close"
+
+	StateOpen    = "open"
+	StateClosed  = "closed"
+	StateOpening = "opening"
+	StateClosing = "closing"
+	StateStopped = "stopped"
+	StateUnknown = "unknown"
+)
+
+// operates garage doors identified by serial; implemented for each supported backend
+type GarageController interface {
+	// returns the current state of the door, e.g. StateOpen or StateClosed
+	State(serial string) (string, error)
+	// requests that the door perform the action, without waiting for it to complete
+	SetState(serial string, action string) error
+}
+
+// returns the controller configured for the car, defaulting to MyQ
+func ForCar(config t.ConfigStruct, car *t.Car) GarageController {
+	switch car.Controller {
+	case ControllerRatgdo:
+		return ratgdoController{}
+	default:
+		return myqController{config: config, account: myqAccountForCar(config, car)}
+	}
+}
+
+// returns true if any car uses MyQ to control its garage doors
+func UsesMyQ(config t.ConfigStruct) bool {
+	return len(myqAccounts(config)) > 0
+}
+
+// implemented by controllers that are notified when a door's state changes, such as ratgdo, so that an
+// action can be confirmed as soon as it completes rather than by polling State
+type StateNotifier interface {
+	// returns a channel that receives each state reported for the door until cancel is called
+	WatchState(serial string) (states <-chan string, cancel func())
+}
+
+// returns true if any car uses MyQ without its own account
+func UsesGlobalMyQAccount(config t.ConfigStruct) bool {
+	for _, car := range config.Cars {
+		if (car.Controller == "" || car.Controller == ControllerMyQ) && car.MyQEmail == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// record the latest state read from a door in metrics and to its mqtt state topic
+func recordDoorState(config t.ConfigStruct, serial string, state string) {
+	metrics.SetDoorState(serial, state)
+	publish.DoorState(config, serial, state)
+}
@@ -0,0 +1,391 @@
+package garage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"myq-teslamate-geofence/internal/metrics"
+	t "myq-teslamate-geofence/internal/types"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joeshaw/myq"
+)
+
+// controls garage doors through the MyQ cloud api
+type myqController struct {
+	config  t.ConfigStruct
+	account myqAccount
+}
+
+func (c myqController) State(serial string) (string, error) {
+	return getDeviceState(c.config, c.account, serial)
+}
+
+func (c myqController) SetState(serial string, action string) error {
+	return setDoorState(c.config, c.account, serial, action)
+}
+
+// MyQ credentials used to control a car's garage doors
+type myqAccount struct {
+	email    string
+	password string
+}
+
+// returns the car's MyQ account, falling back to the global account if the car doesn't define its own
+func myqAccountForCar(config t.ConfigStruct, car *t.Car) myqAccount {
+	if car.MyQEmail != "" {
+		return myqAccount{email: car.MyQEmail, password: car.MyQPass}
+	}
+	return myqAccount{email: config.Global.MyQEmail, password: config.Global.MyQPass}
+}
+
+// returns each distinct MyQ account used by the configured cars
+func myqAccounts(config t.ConfigStruct) []myqAccount {
+	var accounts []myqAccount
+	seen := map[myqAccount]bool{}
+	for _, car := range config.Cars {
+		if car.Controller != "" && car.Controller != ControllerMyQ {
+			continue
+		}
+		if account := myqAccountForCar(config, car); !seen[account] {
+			seen[account] = true
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts
+}
+
+// the subset of *myq.Session used to control garage doors, so that a fake can be substituted for the MyQ cloud
+type myqSession interface {
+	Login() error
+	Devices() ([]myq.Device, error)
+	DeviceState(serialNumber string) (string, error)
+	SetDoorState(serialNumber, action string) error
+}
+
+// creates the MyQ session used by withSession; replaceable to inject a fake session
+var newSession = func(username, password string) myqSession {
+	return &myq.Session{Username: username, Password: password}
+}
+
+// cached MyQ session for an account; the mutex also serializes calls to the session, which isn't safe for
+// concurrent use
+type accountSession struct {
+	sync.Mutex
+	s myqSession
+}
+
+// cached MyQ sessions keyed by account, shared by all cars using the account
+var sessions struct {
+	sync.Mutex
+	m map[myqAccount]*accountSession
+}
+
+// returns the cached session for the account, creating an empty one if needed
+func sessionFor(account myqAccount) *accountSession {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if sessions.m == nil {
+		sessions.m = map[myqAccount]*accountSession{}
+	}
+	if sessions.m[account] == nil {
+		sessions.m[account] = &accountSession{}
+	}
+	return sessions.m[account]
+}
+
+// run fn with the account's cached MyQ session, logging in first if a session hasn't been acquired yet;
+// if fn fails because the session is no longer authenticated, log in again and retry once. all calls to the
+// session are rate limited
+func withSession(config t.ConfigStruct, account myqAccount, fn func(s myqSession) error) error {
+	session := sessionFor(account)
+	session.Lock()
+	defer session.Unlock()
+
+	logger := slog.With("myq_email", account.email)
+	if session.s == nil {
+		s := rateLimitedSession{s: newSession(account.email, account.password), config: config}
+
+		logger.Info("Acquiring MyQ session...")
+		if err := s.Login(); err != nil {
+			logger.Error("Unable to acquire MyQ session", "error", err)
+			return fmt.Errorf("%w: %w", ErrAuth, err)
+		}
+		logger.Info("Session acquired...")
+		session.s = s.s
+	}
+
+	s := rateLimitedSession{s: session.s, config: config}
+	err := fn(s)
+	if errors.Is(err, myq.ErrNotLoggedIn) {
+		logger.Info("MyQ session expired, reacquiring...")
+		if err := s.Login(); err != nil {
+			session.s = nil // force a fresh session on the next call
+			logger.Error("Unable to acquire MyQ session", "error", err)
+			return fmt.Errorf("%w: %w", ErrAuth, err)
+		}
+		logger.Info("Session acquired...")
+		err = fn(s)
+	}
+	return err
+}
+
+// returned when logging in to MyQ fails
+var ErrAuth = errors.New("unable to log in to MyQ")
+
+// returned for a serial that isn't a device on the MyQ account
+var ErrDeviceNotFound = errors.New("device not found on MyQ account")
+
+// matches the error returned by the myq library for a serial that isn't on the account
+var deviceNotFoundRegex = regexp.MustCompile(`^device .* not found$`)
+
+// serials that MyQ reported aren't on each account; calls for them are skipped until the config is reloaded
+var missingDevices struct {
+	sync.Mutex
+	m map[myqAccount]map[string]bool
+}
+
+// returns an error if MyQ previously reported that the serial isn't on the account
+func checkDeviceMissing(account myqAccount, serial string) error {
+	missingDevices.Lock()
+	defer missingDevices.Unlock()
+	if missingDevices.m[account][serial] {
+		return fmt.Errorf("%w: %s", ErrDeviceNotFound, serial)
+	}
+	return nil
+}
+
+// if err is MyQ reporting that the serial isn't on the account, log the serials that are, once, and skip
+// future calls for the serial; returns ErrDeviceNotFound in that case, otherwise err
+func handleDeviceNotFound(s myqSession, account myqAccount, serial string, err error) error {
+	if err == nil || !deviceNotFoundRegex.MatchString(err.Error()) {
+		return err
+	}
+	logger := slog.With("door_serial", serial, "myq_email", account.email)
+	if devices, err := s.Devices(); err != nil {
+		logger.Error("Could not list devices on MyQ account", "error", err)
+	} else {
+		var serials []string
+		for _, device := range devices {
+			serials = append(serials, fmt.Sprintf("%s (%s, %s)", device.SerialNumber, device.Name, device.Type))
+		}
+		logger = logger.With("available_serials", serials)
+	}
+	logger.Error("Garage door serial not found on MyQ account, skipping it until the config is reloaded; check myq_serial in the config")
+
+	missingDevices.Lock()
+	defer missingDevices.Unlock()
+	if missingDevices.m == nil {
+		missingDevices.m = map[myqAccount]map[string]bool{}
+	}
+	if missingDevices.m[account] == nil {
+		missingDevices.m[account] = map[string]bool{}
+	}
+	missingDevices.m[account][serial] = true
+	return fmt.Errorf("%w: %s", ErrDeviceNotFound, serial)
+}
+
+// forget the serials MyQ reported missing so they're tried again, e.g. after the config is reloaded
+func ResetMissingDevices() {
+	missingDevices.Lock()
+	defer missingDevices.Unlock()
+	missingDevices.m = nil
+}
+
+// matches the http status code in errors returned by the myq library
+var statusCodeRegex = regexp.MustCompile(`HTTP status code (\d{3})`)
+
+// returns true if err is likely transient (timeouts, connection failures, and 5xx responses);
+// anything else, such as bad credentials or a missing device, won't be fixed by retrying
+func retryableError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if match := statusCodeRegex.FindStringSubmatch(err.Error()); match != nil {
+		return match[1][0] == '5'
+	}
+	return false
+}
+
+// call fn, retrying up to MyQRetryCount times on retryable errors with exponential backoff and jitter
+func withRetry(config t.ConfigStruct, fn func() error) error {
+	backoff := time.Duration(config.Global.MyQRetryBackoff)
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	err := fn()
+	if err != nil {
+		metrics.MyQAPIErrors.Inc()
+	}
+	for attempt := 1; attempt <= config.Global.MyQRetryCount && err != nil && retryableError(err); attempt++ {
+		delay := backoff<<(attempt-1) + time.Duration(rand.Int63n(int64(backoff)))
+		slog.Debug("MyQ call failed, retrying", "error", err, "delay", delay.Round(time.Millisecond), "attempt", attempt, "max_attempts", config.Global.MyQRetryCount)
+		time.Sleep(delay)
+		if err = fn(); err != nil {
+			metrics.MyQAPIErrors.Inc()
+		}
+	}
+	return err
+}
+
+// acquire a MyQ session for each account used by the configured cars if one isn't already cached, retrying a
+// login that fails with a transient error
+func InitSession(config t.ConfigStruct) error {
+	for _, account := range myqAccounts(config) {
+		err := withRetry(config, func() error {
+			return withSession(config, account, func(s myqSession) error { return nil })
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns true if an authenticated MyQ session is cached for each account used by the configured cars
+func HasSession(config t.ConfigStruct) bool {
+	for _, account := range myqAccounts(config) {
+		session := sessionFor(account)
+		session.Lock()
+		acquired := session.s != nil
+		session.Unlock()
+		if !acquired {
+			return false
+		}
+	}
+	return true
+}
+
+func getDeviceState(config t.ConfigStruct, account myqAccount, deviceSerial string) (state string, err error) {
+	if err := checkDeviceMissing(account, deviceSerial); err != nil {
+		return "", err
+	}
+	err = withRetry(config, func() error {
+		return withSession(config, account, func(s myqSession) error {
+			state, err = s.DeviceState(deviceSerial)
+			return handleDeviceNotFound(s, account, deviceSerial, err)
+		})
+	})
+	if err == nil {
+		recordDoorState(config, deviceSerial, state)
+	}
+	return state, err
+}
+
+func setDoorState(config t.ConfigStruct, account myqAccount, deviceSerial string, action string) error {
+	if err := checkDeviceMissing(account, deviceSerial); err != nil {
+		return err
+	}
+	return withRetry(config, func() error {
+		return withSession(config, account, func(s myqSession) error {
+			return handleDeviceNotFound(s, account, deviceSerial, s.SetDoorState(deviceSerial, action))
+		})
+	})
+}
+
+func getDevices(config t.ConfigStruct, account myqAccount) (devices []myq.Device, err error) {
+	err = withRetry(config, func() error {
+		return withSession(config, account, func(s myqSession) error {
+			devices, err = s.Devices()
+			return err
+		})
+	})
+	return devices, err
+}
+
+// list the devices on each MyQ account used by the enabled cars once, and check that every garage door serial
+// configured for the account is among them; returns ErrDeviceNotFound listing each missing serial along with
+// the serials that are on its account, or the error from listing the devices if they couldn't be listed
+func CheckSerials(config t.ConfigStruct) error {
+	var problems []string
+	for _, account := range myqAccounts(config) {
+		var serials []string
+		seen := map[string]bool{}
+		for _, car := range config.Cars {
+			if (car.Controller != "" && car.Controller != ControllerMyQ) || !car.IsEnabled() || myqAccountForCar(config, car) != account {
+				continue
+			}
+			for _, door := range car.GarageDoors {
+				if !seen[door.MyQSerial] {
+					seen[door.MyQSerial] = true
+					serials = append(serials, door.MyQSerial)
+				}
+			}
+		}
+		if len(serials) == 0 {
+			continue
+		}
+
+		devices, err := getDevices(config, account)
+		if err != nil {
+			return fmt.Errorf("could not list devices on MyQ account %s: %w", account.email, err)
+		}
+		found := map[string]bool{}
+		var available []string
+		for _, device := range devices {
+			found[device.SerialNumber] = true
+			available = append(available, fmt.Sprintf("%s (%s, %s)", device.SerialNumber, device.Name, device.Type))
+		}
+		var missing []string
+		for _, serial := range serials {
+			if !found[serial] {
+				missing = append(missing, serial)
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("%s not on MyQ account %s, which has %s", strings.Join(missing, ", "), account.email,
+				strings.Join(available, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrDeviceNotFound, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// a MyQ device as printed by GetGarageDoorSerials in json format
+type deviceInfo struct {
+	Name   string `json:"name"`
+	Serial string `json:"serial"`
+	Type   string `json:"type"`
+	State  string `json:"state"`
+}
+
+// list the devices on the global MyQ account, logging each one, or printing them to stdout as a json array
+// if format is json; if deviceType is set, only devices whose type contains it (ignoring case) are listed
+func GetGarageDoorSerials(config t.ConfigStruct, format string, deviceType string) error {
+	allDevices, err := getDevices(config, myqAccount{email: config.Global.MyQEmail, password: config.Global.MyQPass})
+	if err != nil {
+		slog.Error("Could not get devices", "error", err)
+		return err
+	}
+	var devices []myq.Device
+	for _, d := range allDevices {
+		if strings.Contains(strings.ToLower(d.Type), strings.ToLower(deviceType)) {
+			devices = append(devices, d)
+		}
+	}
+	if format == "json" {
+		infos := make([]deviceInfo, 0, len(devices))
+		for _, d := range devices {
+			infos = append(infos, deviceInfo{Name: d.Name, Serial: d.SerialNumber, Type: d.Type, State: d.DoorState})
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(infos)
+	}
+	for _, d := range devices {
+		slog.Info("Found device", "name", d.Name, "state", d.DoorState, "type", d.Type, "serial", d.SerialNumber)
+	}
+
+	return nil
+}
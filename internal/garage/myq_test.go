@@ -0,0 +1,288 @@
+package garage
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	t "myq-teslamate-geofence/internal/types"
+
+	"github.com/joeshaw/myq"
+)
+
+// a myqSession that records each call and returns scripted results instead of calling the MyQ cloud
+type fakeSession struct {
+	calls        []string
+	loggedIn     bool
+	loginErr     error
+	nextLoginErr error // returned by the next Login, then cleared
+	devices      []myq.Device
+	states       map[string][]string // states returned for each serial in order; the last one repeats
+	actionErr    error               // returned by the next SetDoorState, then cleared
+}
+
+func (f *fakeSession) Login() error {
+	f.calls = append(f.calls, "Login")
+	if err := f.nextLoginErr; err != nil {
+		f.nextLoginErr = nil
+		return err
+	}
+	if f.loginErr != nil {
+		return f.loginErr
+	}
+	f.loggedIn = true
+	return nil
+}
+
+func (f *fakeSession) Devices() ([]myq.Device, error) {
+	f.calls = append(f.calls, "Devices")
+	if !f.loggedIn {
+		return nil, myq.ErrNotLoggedIn
+	}
+	return f.devices, nil
+}
+
+func (f *fakeSession) DeviceState(serialNumber string) (string, error) {
+	f.calls = append(f.calls, "DeviceState "+serialNumber)
+	if !f.loggedIn {
+		return "", myq.ErrNotLoggedIn
+	}
+	states, ok := f.states[serialNumber]
+	if !ok {
+		return "", fmt.Errorf("device %s not found", serialNumber)
+	}
+	state := states[0]
+	if len(states) > 1 {
+		f.states[serialNumber] = states[1:]
+	}
+	return state, nil
+}
+
+func (f *fakeSession) SetDoorState(serialNumber, action string) error {
+	f.calls = append(f.calls, "SetDoorState "+serialNumber+" "+action)
+	if !f.loggedIn {
+		return myq.ErrNotLoggedIn
+	}
+	if err := f.actionErr; err != nil {
+		f.actionErr = nil
+		return err
+	}
+	if _, ok := f.states[serialNumber]; !ok {
+		return fmt.Errorf("device %s not found", serialNumber)
+	}
+	return nil
+}
+
+// install session as the session returned by newSession, with empty session, missing device, and rate limiter
+// caches, restoring newSession when the test finishes; returns a pointer to the number of sessions created
+func useFakeSession(test *testing.T, session *fakeSession) *int {
+	created := 0
+	original := newSession
+	newSession = func(username, password string) myqSession {
+		created++
+		return session
+	}
+	reset := func() {
+		sessions.Lock()
+		sessions.m = nil
+		sessions.Unlock()
+		ResetMissingDevices()
+		myqLimiter.Lock()
+		myqLimiter.last = time.Time{}
+		myqLimiter.Unlock()
+	}
+	reset()
+	test.Cleanup(func() {
+		newSession = original
+		reset()
+	})
+	return &created
+}
+
+// returns a config that doesn't wait on the rate limiter or between retries
+func testConfig() t.ConfigStruct {
+	var config t.ConfigStruct
+	config.Global.MyQRateLimit = 60_000
+	config.Global.MyQRetryBackoff = t.Duration(time.Millisecond)
+	return config
+}
+
+var testAccount = myqAccount{email: "user@example.com", password: "password"}
+
+func TestWithSessionRelogin(test *testing.T) {
+	session := &fakeSession{states: map[string][]string{"serial": {StateClosed}}}
+	created := useFakeSession(test, session)
+	config := testConfig()
+
+	if state, err := getDeviceState(config, testAccount, "serial"); err != nil || state != StateClosed {
+		test.Fatalf("getDeviceState = %q, %v, want %q, nil", state, err, StateClosed)
+	}
+	// the session expires, so the next call logs in again and is retried
+	session.loggedIn = false
+	if state, err := getDeviceState(config, testAccount, "serial"); err != nil || state != StateClosed {
+		test.Fatalf("getDeviceState after the session expired = %q, %v, want %q, nil", state, err, StateClosed)
+	}
+
+	want := []string{"Login", "DeviceState serial", "DeviceState serial", "Login", "DeviceState serial"}
+	if !reflect.DeepEqual(session.calls, want) {
+		test.Errorf("calls = %q, want %q", session.calls, want)
+	}
+	if *created != 1 {
+		test.Errorf("created %d sessions, want the cached session to be reused", *created)
+	}
+}
+
+func TestWithSessionLoginFails(test *testing.T) {
+	session := &fakeSession{loginErr: errors.New("invalid credentials"), states: map[string][]string{"serial": {StateClosed}}}
+	useFakeSession(test, session)
+	config := testConfig()
+	config.Cars = []*t.Car{{MyQEmail: testAccount.email, MyQPass: testAccount.password}}
+
+	if _, err := getDeviceState(config, testAccount, "serial"); !errors.Is(err, ErrAuth) {
+		test.Errorf("getDeviceState with bad credentials = %v, want ErrAuth", err)
+	}
+	if HasSession(config) {
+		test.Error("HasSession = true after login failed, want false")
+	}
+
+	// once login succeeds the session is cached
+	session.loginErr = nil
+	if err := InitSession(config); err != nil {
+		test.Fatalf("InitSession = %v, want nil", err)
+	}
+	if !HasSession(config) {
+		test.Error("HasSession = false after login succeeded, want true")
+	}
+}
+
+func TestInitSessionRetry(test *testing.T) {
+	session := &fakeSession{nextLoginErr: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	useFakeSession(test, session)
+	config := testConfig()
+	config.Global.MyQRetryCount = 2
+	config.Cars = []*t.Car{{MyQEmail: testAccount.email, MyQPass: testAccount.password}}
+
+	// a login that fails with a network error is retried, keeping the error's cause
+	if err := InitSession(config); err != nil {
+		test.Fatalf("InitSession after a network error = %v, want nil once retried", err)
+	}
+	if want := []string{"Login", "Login"}; !reflect.DeepEqual(session.calls, want) {
+		test.Errorf("calls = %q, want %q", session.calls, want)
+	}
+	if !HasSession(config) {
+		test.Error("HasSession = false after the retried login succeeded, want true")
+	}
+
+	// bad credentials aren't retried
+	sessions.Lock()
+	sessions.m = nil
+	sessions.Unlock()
+	session.calls = nil
+	session.loginErr = errors.New("invalid credentials")
+	if err := InitSession(config); !errors.Is(err, ErrAuth) {
+		test.Errorf("InitSession with bad credentials = %v, want ErrAuth", err)
+	}
+	if want := []string{"Login"}; !reflect.DeepEqual(session.calls, want) {
+		test.Errorf("calls = %q, want %q", session.calls, want)
+	}
+}
+
+func TestHandleDeviceNotFound(test *testing.T) {
+	session := &fakeSession{
+		devices: []myq.Device{{SerialNumber: "serial", Name: "Garage Door", Type: "garagedoor"}},
+		states:  map[string][]string{"serial": {StateClosed}},
+	}
+	useFakeSession(test, session)
+	config := testConfig()
+
+	if _, err := getDeviceState(config, testAccount, "missing"); !errors.Is(err, ErrDeviceNotFound) {
+		test.Fatalf("getDeviceState for a missing serial = %v, want ErrDeviceNotFound", err)
+	}
+	want := []string{"Login", "DeviceState missing", "Devices"}
+	if !reflect.DeepEqual(session.calls, want) {
+		test.Errorf("calls = %q, want %q", session.calls, want)
+	}
+
+	// the missing serial is skipped without calling MyQ until the missing devices are reset
+	session.calls = nil
+	if err := setDoorState(config, testAccount, "missing", ActionOpen); !errors.Is(err, ErrDeviceNotFound) {
+		test.Errorf("setDoorState for a missing serial = %v, want ErrDeviceNotFound", err)
+	}
+	if len(session.calls) != 0 {
+		test.Errorf("calls for a serial already known to be missing = %q, want none", session.calls)
+	}
+	if state, err := getDeviceState(config, testAccount, "serial"); err != nil || state != StateClosed {
+		test.Errorf("getDeviceState for another serial = %q, %v, want %q, nil", state, err, StateClosed)
+	}
+
+	ResetMissingDevices()
+	session.calls = nil
+	if _, err := getDeviceState(config, testAccount, "missing"); !errors.Is(err, ErrDeviceNotFound) {
+		test.Errorf("getDeviceState after ResetMissingDevices = %v, want ErrDeviceNotFound", err)
+	}
+	want = []string{"DeviceState missing", "Devices"}
+	if !reflect.DeepEqual(session.calls, want) {
+		test.Errorf("calls after ResetMissingDevices = %q, want %q", session.calls, want)
+	}
+
+	// other errors are returned as is
+	other := errors.New("HTTP status code 400")
+	if err := handleDeviceNotFound(session, testAccount, "serial", other); err != other {
+		test.Errorf("handleDeviceNotFound(%v) = %v, want the error unchanged", other, err)
+	}
+}
+
+func TestStatePolling(test *testing.T) {
+	session := &fakeSession{states: map[string][]string{"serial": {StateClosed, StateOpening, StateOpening, StateOpen}}}
+	useFakeSession(test, session)
+	controller := myqController{config: testConfig(), account: testAccount}
+
+	if err := controller.SetState("serial", ActionOpen); err != nil {
+		test.Fatalf("SetState = %v, want nil", err)
+	}
+	var states []string
+	for _, want := range []string{StateClosed, StateOpening, StateOpening, StateOpen, StateOpen} {
+		state, err := controller.State("serial")
+		if err != nil {
+			test.Fatalf("State = %v, want nil", err)
+		}
+		states = append(states, state)
+		if state != want {
+			test.Errorf("states = %q, want the scripted states in order", states)
+			break
+		}
+	}
+	if want := "SetDoorState serial open"; session.calls[1] != want {
+		test.Errorf("calls = %q, want %q after logging in", session.calls, want)
+	}
+}
+
+func TestWithRetry(test *testing.T) {
+	session := &fakeSession{states: map[string][]string{"serial": {StateClosed}}}
+	useFakeSession(test, session)
+	config := testConfig()
+	config.Global.MyQRetryCount = 2
+
+	// a transient error is retried
+	session.actionErr = errors.New("HTTP status code 503")
+	if err := setDoorState(config, testAccount, "serial", ActionClose); err != nil {
+		test.Errorf("setDoorState after a 503 = %v, want nil once retried", err)
+	}
+	want := []string{"Login", "SetDoorState serial close", "SetDoorState serial close"}
+	if !reflect.DeepEqual(session.calls, want) {
+		test.Errorf("calls = %q, want %q", session.calls, want)
+	}
+
+	// an error that retrying won't fix isn't retried
+	session.calls = nil
+	session.actionErr = errors.New("HTTP status code 400")
+	if err := setDoorState(config, testAccount, "serial", ActionClose); err == nil {
+		test.Error("setDoorState after a 400 = nil, want the error")
+	}
+	if want := []string{"SetDoorState serial close"}; !reflect.DeepEqual(session.calls, want) {
+		test.Errorf("calls = %q, want %q", session.calls, want)
+	}
+}
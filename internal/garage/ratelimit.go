@@ -0,0 +1,96 @@
+package garage
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	t "myq-teslamate-geofence/internal/types"
+
+	"github.com/joeshaw/myq"
+)
+
+// number of MyQ calls that can be made back to back before calls are spaced out to myq_rate_limit
+const myqRateLimitBurst = 5
+
+// longest a MyQ call waits for the rate limiter before failing
+const myqRateLimitMaxWait = 30 * time.Second
+
+// token bucket shared by all MyQ calls, across accounts, so that bursts from several cars and door state polling
+// stay under MyQ's throttling
+var myqLimiter struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// block until the rate limiter allows another MyQ call, failing if that would take longer than
+// myqRateLimitMaxWait
+func waitForRateLimit(config t.ConfigStruct) error {
+	perMinute := config.Global.MyQRateLimit
+	if perMinute == 0 {
+		perMinute = t.DefaultMyQRateLimit
+	}
+	rate := float64(perMinute) / 60 // tokens per second
+
+	myqLimiter.Lock()
+	now := time.Now()
+	if myqLimiter.last.IsZero() {
+		myqLimiter.tokens = myqRateLimitBurst
+	} else {
+		myqLimiter.tokens = min(myqLimiter.tokens+now.Sub(myqLimiter.last).Seconds()*rate, myqRateLimitBurst)
+	}
+	myqLimiter.last = now
+
+	// reserve a token, waiting for the bucket to refill if it's empty; waiting callers queue up by
+	// taking the bucket further negative
+	myqLimiter.tokens--
+	delay := time.Duration(-myqLimiter.tokens / rate * float64(time.Second))
+	if delay > myqRateLimitMaxWait {
+		myqLimiter.tokens++
+		myqLimiter.Unlock()
+		return fmt.Errorf("timed out waiting for MyQ rate limit of %d calls per minute", perMinute)
+	}
+	myqLimiter.Unlock()
+
+	if delay > 0 {
+		slog.Debug("Waiting for MyQ rate limit", "delay", delay.Round(time.Millisecond), "myq_rate_limit", perMinute)
+		time.Sleep(delay)
+	}
+	return nil
+}
+
+// a MyQ session whose calls all pass through the rate limiter
+type rateLimitedSession struct {
+	s      myqSession
+	config t.ConfigStruct
+}
+
+func (r rateLimitedSession) Login() error {
+	if err := waitForRateLimit(r.config); err != nil {
+		return err
+	}
+	return r.s.Login()
+}
+
+func (r rateLimitedSession) Devices() ([]myq.Device, error) {
+	if err := waitForRateLimit(r.config); err != nil {
+		return nil, err
+	}
+	return r.s.Devices()
+}
+
+func (r rateLimitedSession) DeviceState(serialNumber string) (string, error) {
+	if err := waitForRateLimit(r.config); err != nil {
+		return "", err
+	}
+	return r.s.DeviceState(serialNumber)
+}
+
+func (r rateLimitedSession) SetDoorState(serialNumber, action string) error {
+	if err := waitForRateLimit(r.config); err != nil {
+		return err
+	}
+	return r.s.SetDoorState(serialNumber, action)
+}
@@ -0,0 +1,128 @@
+package garage
+
+import (
+	"fmt"
+	"log/slog"
+	"myq-teslamate-geofence/internal/publish"
+	t "myq-teslamate-geofence/internal/types"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// default ratgdo topics, where %s is the ratgdo device name configured as the door's serial
+const (
+	defaultRatgdoCommandTopic = "ratgdo/%s/command/door"
+	defaultRatgdoStatusTopic  = "ratgdo/%s/status/door"
+)
+
+// controls garage doors running ratgdo firmware over the local mqtt broker; door states are
+// read from the status topics that ratgdo publishes to, which are cached as they're received
+type ratgdoController struct{}
+
+// mqtt client and the latest state received from each ratgdo device
+var ratgdo struct {
+	sync.Mutex
+	client       mqtt.Client
+	commandTopic string
+	qos          byte
+	states       map[string]string
+	watchers     map[string][]chan string
+}
+
+func (c ratgdoController) State(serial string) (string, error) {
+	ratgdo.Lock()
+	defer ratgdo.Unlock()
+	state, ok := ratgdo.states[serial]
+	if !ok {
+		return "", fmt.Errorf("no status received from ratgdo device %s", serial)
+	}
+	return state, nil
+}
+
+func (c ratgdoController) WatchState(serial string) (<-chan string, func()) {
+	states := make(chan string, 10)
+	ratgdo.Lock()
+	if ratgdo.watchers == nil {
+		ratgdo.watchers = map[string][]chan string{}
+	}
+	ratgdo.watchers[serial] = append(ratgdo.watchers[serial], states)
+	ratgdo.Unlock()
+
+	cancel := func() {
+		ratgdo.Lock()
+		defer ratgdo.Unlock()
+		watchers := ratgdo.watchers[serial]
+		for i, watcher := range watchers {
+			if watcher == states {
+				ratgdo.watchers[serial] = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+	}
+	return states, cancel
+}
+
+func (c ratgdoController) SetState(serial string, action string) error {
+	ratgdo.Lock()
+	client, commandTopic, qos := ratgdo.client, ratgdo.commandTopic, ratgdo.qos
+	ratgdo.Unlock()
+	if client == nil {
+		return fmt.Errorf("not connected to mqtt broker for ratgdo device %s", serial)
+	}
+
+	token := client.Publish(fmt.Sprintf(commandTopic, serial), qos, false, action)
+	token.Wait()
+	return token.Error()
+}
+
+// subscribe to the status topic of each garage door controlled by ratgdo; must be called each time
+// the client connects and whenever the config is reloaded so that new doors are subscribed
+func SubscribeRatgdo(client mqtt.Client, config t.ConfigStruct) error {
+	commandTopic := config.Ratgdo.CommandTopic
+	if commandTopic == "" {
+		commandTopic = defaultRatgdoCommandTopic
+	}
+	statusTopic := config.Ratgdo.StatusTopic
+	if statusTopic == "" {
+		statusTopic = defaultRatgdoStatusTopic
+	}
+
+	ratgdo.Lock()
+	ratgdo.client = client
+	ratgdo.commandTopic = commandTopic
+	ratgdo.qos = publish.CommandQoS(config)
+	if ratgdo.states == nil {
+		ratgdo.states = map[string]string{}
+	}
+	ratgdo.Unlock()
+
+	for _, car := range config.Cars {
+		if car.Controller != ControllerRatgdo {
+			continue
+		}
+		for _, door := range car.GarageDoors {
+			serial := door.MyQSerial
+			topic := fmt.Sprintf(statusTopic, serial)
+			slog.Info("Subscribing to ratgdo status topic", "car_id", car.CarID, "door_serial", serial, "topic", topic)
+			token := client.Subscribe(topic, publish.CommandQoS(config), func(client mqtt.Client, message mqtt.Message) {
+				state := string(message.Payload())
+				slog.Debug("Received ratgdo status", "door_serial", serial, "state", state)
+				ratgdo.Lock()
+				ratgdo.states[serial] = state
+				for _, watcher := range ratgdo.watchers[serial] {
+					select {
+					case watcher <- state:
+					default: // don't block the mqtt client on a watcher that isn't keeping up
+					}
+				}
+				ratgdo.Unlock()
+				recordDoorState(config, serial, state)
+			})
+			if token.Wait() && token.Error() != nil {
+				return fmt.Errorf("could not subscribe to %s: %v", topic, token.Error())
+			}
+		}
+	}
+	return nil
+}
@@ -1,25 +1,237 @@
 package geo
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
+	"myq-teslamate-geofence/internal/garage"
+	"myq-teslamate-geofence/internal/metrics"
+	"myq-teslamate-geofence/internal/notify"
+	"myq-teslamate-geofence/internal/publish"
 	t "myq-teslamate-geofence/internal/types"
-	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+)
 
-	"github.com/joeshaw/myq"
+// errors returned when operating a garage door, which can be checked with errors.Is to tell why it failed
+var (
+	ErrAuth           = garage.ErrAuth                                      // logging in to the controller failed
+	ErrDeviceNotFound = garage.ErrDeviceNotFound                            // the serial isn't a device the controller knows of
+	ErrTimeout        = errors.New("timed out waiting for door")            // the door didn't reach the desired state within door_action_timeout
+	ErrStateMismatch  = errors.New("door's state doesn't allow the action") // e.g. the door's state is unknown
+	ErrDoorBusy       = errors.New("door is already being operated")        // a geofence or another manual action holds the door
 )
 
-func withinGeofence(point t.Point, center t.Point, radius float64) bool {
+// returns a short name for why operating a door failed, for metrics labels
+func errorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrAuth):
+		return "auth"
+	case errors.Is(err, ErrDeviceNotFound):
+		return "device_not_found"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrStateMismatch):
+		return "state_mismatch"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "other"
+}
+
+// set by the control topic to stop geofences from operating garage doors; geofences are still evaluated
+var paused atomic.Bool
+
+func init() {
+	metrics.AutomationEnabled.Set(1) // automation starts enabled
+}
+
+// pause or resume geofence automation, publishing the new state
+func SetPaused(config t.ConfigStruct, p bool) {
+	paused.Store(p)
+	if p {
+		metrics.AutomationEnabled.Set(0)
+	} else {
+		metrics.AutomationEnabled.Set(1)
+	}
+	publish.Automation(config, !p)
+}
+
+// returns true if geofence automation is paused
+func Paused() bool {
+	return paused.Load()
+}
+
+// returns the controller that operates the car's garage doors; replaceable to inject a fake controller
+var controllerFor = garage.ForCar
+
+// end of the startup grace period as unix nanoseconds, during which geofences are evaluated without operating
+// garage doors so that the retained messages received on connecting can't trigger an action
+var graceUntil atomic.Int64
+
+// start the startup grace period, logging when it ends; a period of 0 disables it
+func StartGracePeriod(config t.ConfigStruct) {
+	period := t.DefaultStartupGracePeriod
+	if config.Global.StartupGracePeriod != nil {
+		period = time.Duration(*config.Global.StartupGracePeriod)
+	}
+	if period <= 0 {
+		return
+	}
+	graceUntil.Store(time.Now().Add(period).UnixNano())
+	slog.Info("Garage doors won't be operated until the startup grace period ends", "startup_grace_period", period)
+	time.AfterFunc(period, func() {
+		slog.Info("Startup grace period ended, garage doors will be operated")
+	})
+}
+
+// returns true if the startup grace period hasn't ended
+func inGracePeriod() bool {
+	return time.Now().UnixNano() < graceUntil.Load()
+}
+
+// returns true if the point is within the geofence; buffer is added to the radius of circular geofences and moves
+// the edges of polygons outward, so a positive buffer grows the geofence and a negative one shrinks it. if the
+// geofence has an elevation band, the elevation must also be within it, unless the elevation is nil (unknown).
+// a geofence made up of other geofences is combined per its match, with the buffer applied to each
+func withinGeofence(measure distanceFunc, point t.Point, elevation *float64, geofence t.Geofence, buffer t.Distance) bool {
+	if !withinElevation(elevation, geofence) {
+		return false
+	}
+	if len(geofence.Geofences) > 0 {
+		matchAll := geofence.MatchMode() == t.GeofenceMatchAll
+		for _, g := range geofence.Geofences {
+			if withinGeofence(measure, point, elevation, g, buffer) != matchAll {
+				return !matchAll
+			}
+		}
+		return matchAll
+	}
+	if len(geofence.Polygon) > 0 {
+		inside := withinPolygon(point, geofence.Polygon)
+		switch {
+		case buffer > 0 && !inside:
+			return distanceToEdge(point, geofence.Polygon) <= float64(buffer)
+		case buffer < 0 && inside:
+			return distanceToEdge(point, geofence.Polygon) >= float64(-buffer)
+		}
+		return inside
+	}
 	// Calculate the distance between the point and the center of the circle
-	distance := distance(point, center)
-	return distance <= radius
+	distance := measure(point, geofence.Center)
+	return distance <= float64(geofence.Radius+buffer)
+}
+
+// returns true if the elevation is within the geofence's min_elevation and max_elevation, or if either the
+// elevation or the band isn't known
+func withinElevation(elevation *float64, geofence t.Geofence) bool {
+	if elevation == nil {
+		return true
+	}
+	if geofence.MinElevation != nil && *elevation < float64(*geofence.MinElevation) {
+		return false
+	}
+	if geofence.MaxElevation != nil && *elevation > float64(*geofence.MaxElevation) {
+		return false
+	}
+	return true
 }
 
+// check if a point is inside a polygon using the ray casting algorithm;
+// lat and lng are treated as planar coordinates, which is accurate enough for geofence-sized polygons
+func withinPolygon(point t.Point, polygon []t.Point) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		vi, vj := polygon[i], polygon[j]
+		// toggle inside for each polygon edge crossed by a ray cast east from the point
+		if (vi.Lat > point.Lat) != (vj.Lat > point.Lat) &&
+			point.Lng < (vj.Lng-vi.Lng)*(point.Lat-vi.Lat)/(vj.Lat-vi.Lat)+vi.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// returns the distance in meters from the point to the nearest edge of the polygon, treating lat and lng as
+// planar coordinates scaled to meters at the point's latitude, which is accurate enough for geofence-sized polygons
+func distanceToEdge(point t.Point, polygon []t.Point) float64 {
+	const metersPerDegree = 111320 // of latitude, and of longitude at the equator
+	scaleLng := metersPerDegree * math.Cos(toRadians(point.Lat))
+	nearest := math.Inf(1)
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		// the edge from vj to vi, relative to the point
+		ax, ay := (polygon[j].Lng-point.Lng)*scaleLng, (polygon[j].Lat-point.Lat)*metersPerDegree
+		bx, by := (polygon[i].Lng-point.Lng)*scaleLng, (polygon[i].Lat-point.Lat)*metersPerDegree
+		dx, dy := bx-ax, by-ay
+		// fraction of the way along the edge of the point closest to the origin
+		fraction := 0.0
+		if lengthSq := dx*dx + dy*dy; lengthSq > 0 {
+			fraction = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSq))
+		}
+		nearest = math.Min(nearest, math.Hypot(ax+fraction*dx, ay+fraction*dy))
+	}
+	return nearest
+}
+
+// describe where the point is relative to the geofence, for debugging boundary issues
+func describeGeofence(measure distanceFunc, point t.Point, elevation *float64, geofence t.Geofence, buffer t.Distance) string {
+	var description string
+	if len(geofence.Geofences) > 0 {
+		descriptions := make([]string, len(geofence.Geofences))
+		for i, g := range geofence.Geofences {
+			descriptions[i] = describeGeofence(measure, point, elevation, g, buffer)
+		}
+		description = fmt.Sprintf("%s of [%s], inside: %t", geofence.MatchMode(), strings.Join(descriptions, "; "), withinGeofence(measure, point, elevation, geofence, buffer))
+	} else if len(geofence.Polygon) > 0 {
+		description = fmt.Sprintf("polygon, inside: %t, distance to edge: %.1fm, buffer: %.1fm", withinPolygon(point, geofence.Polygon),
+			distanceToEdge(point, geofence.Polygon), float64(buffer))
+	} else {
+		description = fmt.Sprintf("distance: %.1fm, radius: %.1fm, buffer: %.1fm", measure(point, geofence.Center), float64(geofence.Radius), float64(buffer))
+	}
+	if (geofence.MinElevation != nil || geofence.MaxElevation != nil) && elevation != nil {
+		description += fmt.Sprintf(", elevation: %.1fm, within elevation band: %t", *elevation, withinElevation(elevation, geofence))
+	}
+	return description
+}
+
+// returns the geofence used to determine when to close the garage;
+// falls back to the open geofence if a close geofence isn't defined
+func closeGeofence(door *t.GarageDoor) t.Geofence {
+	if !door.GarageCloseGeo.Defined() {
+		return door.GarageOpenGeo
+	}
+	return door.GarageCloseGeo
+}
+
+// returns the geofence used to determine when to open the garage;
+// falls back to the close geofence if an open geofence isn't defined
+func openGeofence(door *t.GarageDoor) t.Geofence {
+	if !door.GarageOpenGeo.Defined() {
+		return door.GarageCloseGeo
+	}
+	return door.GarageOpenGeo
+}
+
+// returns the distance in meters between two points
+type distanceFunc func(point1 t.Point, point2 t.Point) float64
+
+// returns the distance function for the configured distance_model, defaulting to haversine
+func distanceModel(config t.ConfigStruct) distanceFunc {
+	if config.Global.DistanceModel == t.DistanceModelVincenty {
+		return vincentyDistance
+	}
+	return distance
+}
+
+// returns the distance in meters between two points on a sphere
 func distance(point1 t.Point, point2 t.Point) float64 {
 	// Calculate the distance between two points using the haversine formula
-	const radius = 6371 // Earth's radius in kilometers
+	const radius = 6371000 // Earth's radius in meters
 	lat1 := toRadians(point1.Lat)
 	lat2 := toRadians(point2.Lat)
 	deltaLat := toRadians(point2.Lat - point1.Lat)
@@ -30,146 +242,835 @@ func distance(point1 t.Point, point2 t.Point) float64 {
 	return d
 }
 
+// returns the distance in meters between two points on the WGS-84 ellipsoid using Vincenty's inverse formula,
+// which is accurate to within millimeters; falls back to haversine for nearly antipodal points, where the
+// formula doesn't converge
+func vincentyDistance(point1 t.Point, point2 t.Point) float64 {
+	const (
+		a = 6378137.0         // semi-major axis in meters
+		f = 1 / 298.257223563 // flattening
+		b = a * (1 - f)       // semi-minor axis in meters
+	)
+	L := toRadians(point2.Lng - point1.Lng)
+	U1 := math.Atan((1 - f) * math.Tan(toRadians(point1.Lat)))
+	U2 := math.Atan((1 - f) * math.Tan(toRadians(point2.Lat)))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	for i := 0; i < 200; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Sqrt(math.Pow(cosU2*sinLambda, 2) + math.Pow(cosU1*sinU2-sinU1*cosU2*cosLambda, 2))
+		if sinSigma == 0 {
+			return 0 // coincident points
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0 // on the equator
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		C := f / 16 * cosSqAlpha * (4 + f*(4-3*cosSqAlpha))
+		prevLambda := lambda
+		lambda = L + (1-C)*f*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+
+		if math.Abs(lambda-prevLambda) < 1e-12 {
+			uSq := cosSqAlpha * (a*a - b*b) / (b * b)
+			A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+			B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+			deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+				B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+			return b * A * (sigma - deltaSigma)
+		}
+	}
+	return distance(point1, point2)
+}
+
 func toRadians(degrees float64) float64 {
 	return degrees * math.Pi / 180
 }
 
-// check if outside close geo or inside open geo and set garage door state accordingly
-func CheckGeoFence(config t.ConfigStruct, car *t.Car) {
-	if car.OpLock {
+// returns true if both a latitude and longitude have been received for the position. a coordinate of exactly 0
+// is the unset value, so it's treated as missing rather than risk acting on a position that was never received,
+// meaning points on the equator or prime meridian (e.g. 0,0 in the Gulf of Guinea) are never evaluated
+func hasPosition(position t.Position) bool {
+	return position.Point.Lat != 0 && position.Point.Lng != 0
+}
+
+// check each of the car's garage doors independently against position, the copy of the car's position taken
+// when the check was queued; cancelling ctx stops waiting for doors that are being operated
+func CheckGeoFence(ctx context.Context, config t.ConfigStruct, car *t.Car, position t.Position) {
+	car.Lock()
+	recordPosition(car, position)
+	car.Unlock()
+
+	var wg sync.WaitGroup
+	for _, door := range car.GarageDoors {
+		wg.Add(1)
+		go func(door *t.GarageDoor) {
+			defer wg.Done()
+			checkGarageDoor(ctx, config, car, door, position)
+		}(door)
+	}
+	wg.Wait()
+}
+
+// add position to the car's recent positions if it has a smoothing_window; caller must hold the car's lock
+func recordPosition(car *t.Car, position t.Position) {
+	if car.SmoothingWindow <= 1 || car.TriggerOnGeofenceName != "" || !hasPosition(position) {
+		car.RecentPoints = nil
 		return
 	}
-	car.OpLock = true
-	if car.CurLat == 0 || car.CurLng == 0 {
-		car.OpLock = false
+	car.RecentPoints = append(car.RecentPoints, position.Point)
+	if extra := len(car.RecentPoints) - car.SmoothingWindow; extra > 0 {
+		car.RecentPoints = append(car.RecentPoints[:0], car.RecentPoints[extra:]...)
+	}
+}
+
+// returns the point to check the car's geofences against: the average of its recent positions if it has a
+// smoothing_window, otherwise point. caller must hold the car's lock
+func smoothedPosition(car *t.Car, point t.Point) t.Point {
+	if len(car.RecentPoints) == 0 {
+		return point
+	}
+	var average t.Point
+	for _, recent := range car.RecentPoints {
+		average.Lat += recent.Lat
+		average.Lng += recent.Lng
+	}
+	average.Lat /= float64(len(car.RecentPoints))
+	average.Lng /= float64(len(car.RecentPoints))
+	return average
+}
+
+// decide what the car's position means for the door with EvaluateTransition, then apply the cooldown,
+// confirmations, dwell time, suppression, and delays before updating the door's state and operating it
+func checkGarageDoor(ctx context.Context, config t.ConfigStruct, car *t.Car, door *t.GarageDoor, position t.Position) {
+	car.Lock()
+	if door.OpLock {
+		car.Unlock()
+		return
+	}
+	if car.TriggerOnGeofenceName == "" && !hasPosition(position) {
+		car.Unlock()
 		return // need valid lat and lng to check fence
 	}
+	// the first position only determines whether the car starts out home, without operating the door
+	if !door.Initialized {
+		initializeAtHome(config, car, door, position)
+		car.Unlock()
+		return
+	}
+	// skip checking while the car is stationary so gps drift of a parked car doesn't cross a geofence;
+	// if teslamate hasn't reported a speed, the car is always checked
+	if car.MinTriggerSpeed > 0 && car.SpeedKnown && car.CurSpeed < car.MinTriggerSpeed {
+		slog.Debug("Skipping geofence check, car is below min trigger speed", "car_id", car.CarID, "door_serial", door.MyQSerial,
+			"speed", car.CurSpeed, "min_trigger_speed", car.MinTriggerSpeed)
+		car.Unlock()
+		return
+	}
+	smoothed := position
+	smoothed.Point = smoothedPosition(car, position.Point)
+	action, reason, atHome := EvaluateTransition(config, car, door, smoothed)
+
+	// a position that has stopped updating, e.g. while teslamate or the car is offline, may no longer be where the
+	// car is, so it's never acted on
+	if maxAge := time.Duration(config.Global.MaxPositionAge); action != "" && maxAge > 0 {
+		if age := positionAge(car, position); age > maxAge {
+			slog.Warn(fmt.Sprintf("Not operating garage door, position is stale, would %s", action), "car_id", car.CarID,
+				"door_serial", door.MyQSerial, "action", action, "reason", reason, "position_age", age.Round(time.Second),
+				"max_position_age", maxAge)
+			door.Confirmations, door.PendingSince = 0, time.Time{}
+			car.Unlock()
+			return
+		}
+	}
+
+	// skip checking until the cooldown for the last action has passed to prevent flapping in case of overlapping geofences;
+	// a crossing during the cooldown is reported once, since it's easily mistaken for the app not working
+	if remaining := CooldownRemaining(config, car, door); remaining > 0 {
+		if action != "" && action != door.CooldownSkipped {
+			slog.Info(fmt.Sprintf("Not operating garage door during cooldown, would %s", action), "car_id", car.CarID,
+				"door_serial", door.MyQSerial, "action", action, "reason", reason, "cooldown_remaining", remaining.Round(time.Second))
+			publish.CooldownRemaining(config, car.CarID, door.MyQSerial, remaining)
+		}
+		door.CooldownSkipped = action
+		car.Unlock()
+		return
+	}
+	door.CooldownSkipped = ""
 
-	// Define a point to check
-	point := t.Point{
-		Lat: car.CurLat,
-		Lng: car.CurLng,
+	// while an action is scheduled, the car either stays across the geofence and the action goes ahead when its
+	// delay is up, or turns back and the action is cancelled
+	if door.Scheduled != "" {
+		if action == door.Scheduled {
+			car.Unlock()
+			return
+		}
+		slog.Info(fmt.Sprintf("Cancelled scheduled garage door %s, car turned back", door.Scheduled), "car_id", car.CarID,
+			"door_serial", door.MyQSerial, "action", door.Scheduled)
+		cancelScheduled(door)
 	}
+	door.OpLock = true
 
-	var action string
-	withinGeofence := withinGeofence(point, car.GarageCloseGeo.Center, car.GarageCloseGeo.Radius)
+	// require the configured number of consecutive updates, and the car to have stayed for the dwell time, on the
+	// far side of the geofence before acting, so a single bad fix or driving past the edge doesn't operate the door;
+	// any update that doesn't agree starts both over
+	if action == "" {
+		door.Confirmations, door.PendingSince = 0, time.Time{}
+	} else {
+		if door.PendingSince.IsZero() {
+			door.PendingSince = time.Now()
+		}
+		door.Confirmations++
+		if door.Confirmations < car.RequiredConfirmations {
+			slog.Debug("Awaiting confirmation before operating garage door", "car_id", car.CarID, "door_serial", door.MyQSerial,
+				"action", action, "confirmations", door.Confirmations, "required", car.RequiredConfirmations)
+			action = ""
+		} else if dwell, elapsed := dwellTime(config, car), time.Since(door.PendingSince); elapsed < dwell {
+			slog.Debug("Awaiting dwell time before operating garage door", "car_id", car.CarID, "door_serial", door.MyQSerial,
+				"action", action, "elapsed", elapsed.Round(time.Second), "dwell_time", dwell)
+			action = ""
+		}
+	}
 
-	if car.AtHome && !withinGeofence { // check if outside the close geofence, meaning we should close the door
-		action = myq.ActionClose
-	} else if !car.AtHome && withinGeofence {
-		action = myq.ActionOpen
+	// a plugged in car can't be leaving, so leaving while plugged in is gps drift rather than a crossing
+	if action != "" && door.AtHome && car.SuppressCloseWhilePluggedIn && car.PluggedIn {
+		slog.Info("Not operating garage door for car leaving while plugged in", "car_id", car.CarID, "door_serial", door.MyQSerial,
+			"action", action, "reason", reason)
+		door.Confirmations, door.PendingSince = 0, time.Time{}
+		action = ""
 	}
 
+	// crossings are reported to webhooks whether or not the door is operated
 	if action != "" {
-		log.Printf("Attempting to %s garage door for car %d", action, car.CarID)
-		setGarageDoor(config, car.MyQSerial, action)
-		car.AtHome = !car.AtHome                                          // toggle CarAtHome status
-		time.Sleep(time.Duration(config.Global.OpCooldown) * time.Minute) // keep opLock true for OpCooldown minutes to prevent flapping in case of overlapping geofences
+		event := notify.EventEntered
+		if door.AtHome {
+			event = notify.EventExited
+		}
+		notify.Webhook(config.Webhooks, notify.Event{CarID: car.CarID, DoorSerial: door.MyQSerial, Event: event,
+			Lat: position.Point.Lat, Lng: position.Point.Lng, Timestamp: time.Now()})
 	}
 
-	car.OpLock = false
+	// if the car's mode or active hours don't allow the action, track that the car crossed the geofence but leave
+	// the door as is
+	var suppressedBy string
+	if action != "" && !modeAllows(car.Mode, action) {
+		suppressedBy = "mode " + car.Mode
+	} else if action != "" && !car.ActiveHours.Allows(action, time.Now()) {
+		suppressedBy = "active hours"
+	} else if action != "" && time.Now().Before(door.DisabledUntil) {
+		suppressedBy = "circuit breaker"
+	} else if action != "" && Paused() {
+		suppressedBy = "automation being paused"
+	} else if action != "" && inGracePeriod() {
+		suppressedBy = "startup grace period"
+	}
+	if suppressedBy != "" {
+		slog.Info(fmt.Sprintf("Not operating garage door due to %s, would %s", suppressedBy, action), "car_id", car.CarID,
+			"door_serial", door.MyQSerial, "action", action, "reason", reason)
+		door.AtHome = atHome
+		door.Confirmations, door.PendingSince = 0, time.Time{}
+		action = ""
+		publishAtHome(config, car, door)
+	}
+
+	// report where the car is relative to the geofence that applies to the door's current state, for tuning radii
+	var details string
+	if car.TriggerOnGeofenceName != "" {
+		details = fmt.Sprintf("teslamate geofence: %q", position.Geofence)
+	} else {
+		name, geofence, buffer := "close", closeGeofence(door), car.GeofenceBuffer
+		if !door.AtHome {
+			name, geofence, buffer = "open", openGeofence(door), -car.GeofenceBuffer
+		}
+		details = name + " geofence " + describeGeofence(distanceModel(config), smoothed.Point, smoothed.Elevation, geofence, buffer)
+		if config.Global.PublishDistance && len(geofence.Polygon) == 0 && len(geofence.Geofences) == 0 {
+			publish.Distance(config, car.CarID, door.MyQSerial, distanceModel(config)(smoothed.Point, geofence.Center))
+		}
+	}
+	if config.DryRun {
+		slog.Info("DRY RUN - evaluated geofence", "car_id", car.CarID, "door_serial", door.MyQSerial, "at_home", door.AtHome, "details", details)
+	} else {
+		slog.Debug("Evaluated geofence", "car_id", car.CarID, "door_serial", door.MyQSerial, "at_home", door.AtHome, "details", details)
+	}
+	if delay := actionDelay(car, action); delay > 0 {
+		scheduleAction(ctx, config, car, door, action, reason, positionReceived(car, position), delay)
+		door.OpLock = false
+		car.Unlock()
+		return
+	}
+	car.Unlock()
+
+	if action != "" {
+		actuateGarageDoor(ctx, config, car, door, action, reason, positionReceived(car, position))
+	}
+
+	car.Lock()
+	door.OpLock = false
+	car.Unlock()
+}
+
+// returns how long ago the position the car's geofences are checked against was received; the teslamate geofence
+// for cars using trigger_on_geofence_name, otherwise the older of the latitude and longitude. a position with no
+// receive time, e.g. one being replayed, is treated as current
+func positionAge(car *t.Car, position t.Position) time.Duration {
+	received := position.GeofenceTime
+	if car.TriggerOnGeofenceName == "" {
+		received = position.LatTime
+		if position.LngTime.Before(received) {
+			received = position.LngTime
+		}
+	}
+	if received.IsZero() {
+		return 0
+	}
+	return time.Since(received)
 }
 
-func setGarageDoor(config t.ConfigStruct, deviceSerial string, action string) error {
-	s := &myq.Session{}
-	s.Username = config.Global.MyQEmail
-	s.Password = config.Global.MyQPass
+// returns when the position that the car's geofences are checked against was received, the newer of the
+// latitude and longitude or the teslamate geofence, or the zero time if it wasn't received over mqtt
+func positionReceived(car *t.Car, position t.Position) time.Time {
+	if car.TriggerOnGeofenceName != "" {
+		return position.GeofenceTime
+	}
+	if position.LatTime.After(position.LngTime) {
+		return position.LatTime
+	}
+	return position.LngTime
+}
 
-	var desiredState string
+// returns how long to wait before taking the action; the car's open_delay or close_delay, or 0 for no action
+func actionDelay(car *t.Car, action string) time.Duration {
 	switch action {
-	case myq.ActionOpen:
-		desiredState = myq.StateOpen
-	case myq.ActionClose:
-		desiredState = myq.StateClosed
+	case garage.ActionOpen:
+		return time.Duration(car.OpenDelay)
+	case garage.ActionClose:
+		return time.Duration(car.CloseDelay)
 	}
+	return 0
+}
 
-	if config.Testing {
-		log.Printf("TESTING flag set - Would attempt action %v", action)
-		return nil
+// take the action once the delay is up, unless it's cancelled first because the car turned back; caller must
+// hold the car's lock. the door is op locked while the action is taken, as if the action hadn't been delayed
+func scheduleAction(ctx context.Context, config t.ConfigStruct, car *t.Car, door *t.GarageDoor, action string, reason string,
+	received time.Time, delay time.Duration) {
+	slog.Info(fmt.Sprintf("Scheduled garage door %s", action), "car_id", car.CarID, "door_serial", door.MyQSerial,
+		"action", action, "reason", reason, "delay", delay)
+	door.Scheduled = action
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		car.Lock()
+		// a cancelled timer may already have fired and be waiting on the lock
+		if door.ScheduledTimer != timer {
+			car.Unlock()
+			return
+		}
+		door.Scheduled, door.ScheduledTimer = "", nil
+		if door.OpLock {
+			// a manual action is already operating the door
+			slog.Info(fmt.Sprintf("Skipping scheduled garage door %s, door is already being operated", action), "car_id", car.CarID,
+				"door_serial", door.MyQSerial, "action", action)
+			car.Unlock()
+			return
+		}
+		door.OpLock = true
+		car.Unlock()
+
+		actuateGarageDoor(ctx, config, car, door, action, reason, received)
+
+		car.Lock()
+		door.OpLock = false
+		car.Unlock()
+	})
+	door.ScheduledTimer = timer
+}
+
+// stop the door's scheduled action, if any; caller must hold the car's lock
+func cancelScheduled(door *t.GarageDoor) {
+	if door.ScheduledTimer != nil {
+		door.ScheduledTimer.Stop()
 	}
+	door.Scheduled, door.ScheduledTimer = "", nil
+}
 
-	log.Println("Acquiring MyQ session...")
-	if err := s.Login(); err != nil {
-		log.SetOutput(os.Stderr)
-		log.Printf("ERROR: %v\n", err)
-		log.SetOutput(os.Stdout)
-		return err
+// returns how long to wait after the action before checking the geofences again; the car's open_cooldown or
+// close_cooldown if set, otherwise the global cooldown
+func cooldown(config t.ConfigStruct, car *t.Car, lastAction string) time.Duration {
+	cooldown := config.Global.OpCooldown
+	if lastAction == garage.ActionOpen && car.OpenCooldown != nil {
+		cooldown = *car.OpenCooldown
+	} else if lastAction == garage.ActionClose && car.CloseCooldown != nil {
+		cooldown = *car.CloseCooldown
 	}
-	log.Println("Session acquired...")
+	return time.Duration(cooldown)
+}
 
-	curState, err := s.DeviceState(deviceSerial)
-	if err != nil {
-		log.Printf("Couldn't get device state: %v", err)
-		return err
+// decides what the car being at position means for the door, without changing any state or operating the door: the
+// action to take and why, or "" if the car hasn't crossed the geofence that applies to the door's current state,
+// and whether the car is home once the crossing is accounted for. with invert_actions, the door is opened when the
+// car leaves and closed when it arrives. confirmations, dwell times, cooldowns, and suppression are left to the
+// caller. caller must hold the car's lock
+func EvaluateTransition(config t.ConfigStruct, car *t.Car, door *t.GarageDoor, position t.Position) (action string, reason string, atHome bool) {
+	action, reason = crossing(config, car, door, position)
+	if action == "" {
+		return "", "", door.AtHome
+	}
+	atHome = action == garage.ActionOpen
+	if car.InvertActions {
+		return oppositeAction(action), reason + ", inverted by invert_actions", atHome
 	}
+	return action, reason, atHome
+}
 
-	log.Printf("Requested action: %v, Current state: %v", action, curState)
-	if (action == myq.ActionOpen && curState == myq.StateClosed) || (action == myq.ActionClose && curState == myq.StateOpen) {
-		log.Printf("Attempting action: %v", action)
-		err := s.SetDoorState(deviceSerial, action)
-		if err != nil {
-			log.Printf("Unable to set door state: %v", err)
-			return err
+// returns close if the car left the geofence that applies to the door's current state, or open if it entered it,
+// and why, or "" if it hasn't crossed it; caller must hold the car's lock
+func crossing(config t.ConfigStruct, car *t.Car, door *t.GarageDoor, position t.Position) (action string, reason string) {
+	if car.TriggerOnGeofenceName != "" {
+		atGeofence := position.Geofence == car.TriggerOnGeofenceName
+		if door.AtHome && !atGeofence { // check if the car left the teslamate geofence, meaning we should close the door
+			return garage.ActionClose, fmt.Sprintf("car left teslamate geofence %s", car.TriggerOnGeofenceName)
+		} else if !door.AtHome && atGeofence { // check if the car entered the teslamate geofence, meaning we should open the door
+			return garage.ActionOpen, fmt.Sprintf("car entered teslamate geofence %s", car.TriggerOnGeofenceName)
 		}
+	} else if door.AtHome && !withinGeofence(distanceModel(config), position.Point, position.Elevation, closeGeofence(door), car.GeofenceBuffer) { // check if outside the close geofence plus buffer, meaning we should close the door
+		return garage.ActionClose, "car left close geofence"
+	} else if !door.AtHome && withinGeofence(distanceModel(config), position.Point, position.Elevation, openGeofence(door), -car.GeofenceBuffer) { // check if inside the open geofence minus buffer, meaning we should open the door
+		return garage.ActionOpen, "car entered open geofence"
+	}
+	return "", ""
+}
+
+// returns how much longer the door's cooldown from its last action lasts, or 0 if it has passed; caller must
+// hold the car's lock
+func CooldownRemaining(config t.ConfigStruct, car *t.Car, door *t.GarageDoor) time.Duration {
+	return max(cooldown(config, car, door.LastAction)-time.Since(door.LastActionTime), 0)
+}
+
+// returns how long the car must stay on the far side of a geofence before the door is operated; the car's
+// dwell_time if set, otherwise the global dwell_time
+func dwellTime(config t.ConfigStruct, car *t.Car) time.Duration {
+	if car.DwellTime != nil {
+		return time.Duration(*car.DwellTime)
+	}
+	return time.Duration(config.Global.DwellTime)
+}
+
+// returns true if the car's mode allows the action
+func modeAllows(mode string, action string) bool {
+	switch mode {
+	case t.ModeOpenOnly:
+		return action == garage.ActionOpen
+	case t.ModeCloseOnly:
+		return action == garage.ActionClose
+	}
+	return true
+}
+
+// publish the door's AtHome status, and whether the car is home at all; caller must hold the car's lock
+func publishAtHome(config t.ConfigStruct, car *t.Car, door *t.GarageDoor) {
+	publish.AtHome(config, car.CarID, door.MyQSerial, door.AtHome)
+	PublishCarHome(config, car)
+}
+
+// publish whether the car is home, meaning any of its initialized doors consider it home; nothing is published
+// until a door has been initialized. caller must hold the car's lock
+func PublishCarHome(config t.ConfigStruct, car *t.Car) {
+	initialized, home := false, false
+	for _, door := range car.GarageDoors {
+		if door.Initialized {
+			initialized = true
+			home = home || door.AtHome
+		}
+	}
+	if initialized {
+		publish.CarHome(config, car.CarID, home)
+	}
+}
+
+// set the door's AtHome status from the car's position; a car between the close and open geofences is considered
+// home so that the worst case is closing the door rather than opening it. caller must hold the car's lock
+func initializeAtHome(config t.ConfigStruct, car *t.Car, door *t.GarageDoor, position t.Position) {
+	if car.TriggerOnGeofenceName != "" {
+		door.AtHome = position.Geofence == car.TriggerOnGeofenceName
 	} else {
-		log.Printf("Action and state mismatch: garage state is not valid for executing requested action")
-		return nil
+		door.AtHome = withinGeofence(distanceModel(config), position.Point, position.Elevation, openGeofence(door), 0)
 	}
+	door.Initialized = true
+	slog.Info("Initialized garage door state from first position", "car_id", car.CarID, "door_serial", door.MyQSerial, "at_home", door.AtHome)
+	publishAtHome(config, car, door)
+}
 
-	log.Printf("Waiting for door to %s...\n", action)
+// set each door's AtHome status from the car's position without operating it; used for the retained
+// position that teslamate's topics replay when the app (re)connects, since the car may have come or gone while
+// the app was down or disconnected. doors being operated are skipped. caller must hold the car's lock
+func ReconcileAtHome(config t.ConfigStruct, car *t.Car, position t.Position) {
+	if car.TriggerOnGeofenceName == "" && !hasPosition(position) {
+		return
+	}
+	for _, door := range car.GarageDoors {
+		if door.OpLock {
+			continue
+		}
+		if !door.Initialized {
+			initializeAtHome(config, car, door, position)
+			continue
+		}
+		_, reason, atHome := EvaluateTransition(config, car, door, position)
+		if atHome == door.AtHome {
+			slog.Debug("Retained position agrees with garage door state", "car_id", car.CarID, "door_serial", door.MyQSerial, "at_home", door.AtHome)
+			continue
+		}
+		door.AtHome = atHome
+		door.Confirmations, door.PendingSince = 0, time.Time{}
+		slog.Info("Reconciled garage door state from retained position without operating the door", "car_id", car.CarID,
+			"door_serial", door.MyQSerial, "at_home", door.AtHome, "reason", reason)
+		publishAtHome(config, car, door)
+	}
+}
 
-	var currentState string
-	deadline := time.Now().Add(60 * time.Second)
-	for time.Now().Before(deadline) {
-		state, err := s.DeviceState(deviceSerial)
+// open or close the garage door and toggle its AtHome status; received is when the position that triggered the
+// action was received, for measuring how long the door took. caller must hold the door's OpLock
+func actuateGarageDoor(ctx context.Context, config t.ConfigStruct, car *t.Car, door *t.GarageDoor, action string, reason string,
+	received time.Time) {
+	if config.DryRun {
+		slog.Info(fmt.Sprintf("DRY RUN - would %s garage door", action), "car_id", car.CarID, "door_serial", door.MyQSerial, "action", action, "reason", reason)
+	} else {
+		slog.Info(fmt.Sprintf("Attempting to %s garage door", action), "car_id", car.CarID, "door_serial", door.MyQSerial, "action", action, "reason", reason)
+		metrics.DoorActions.WithLabelValues(strconv.Itoa(car.CarID), action).Inc()
+		err := setGarageDoor(ctx, config, controllerFor(config, car), door.MyQSerial, action, door.ConfirmsStateChange())
+		car.Lock()
+		recordResult(config, car, door, err)
+		car.Unlock()
 		if err != nil {
-			return err
+			metrics.DoorActionFailures.WithLabelValues(strconv.Itoa(car.CarID), action, errorReason(err)).Inc()
+		} else if door.ConfirmsStateChange() && !config.Testing && !received.IsZero() {
+			// the time from the car's position to the door being open or closed, which includes any confirmations,
+			// dwell time, and delay as well as the controller, for telling a slow controller from a small geofence
+			latency := time.Since(received)
+			slog.Info(fmt.Sprintf("Garage door %s completed", action), "car_id", car.CarID, "door_serial", door.MyQSerial,
+				"action", action, "since_position", latency.Round(time.Millisecond))
+			metrics.DoorActionDuration.WithLabelValues(strconv.Itoa(car.CarID), action).Observe(latency.Seconds())
 		}
-		if state != currentState {
-			if currentState != "" {
-				log.Printf("Door state changed to %s\n", state)
+		if !config.Testing {
+			var state string
+			switch {
+			case err == nil && !door.ConfirmsStateChange():
+				// the door's state wasn't checked after the command, so don't claim it reached it
+				notify.Send(config.Notifications, "Garage door "+action,
+					fmt.Sprintf("Sent %s command to garage door %s for car %d because %s", action, door.MyQSerial, car.CarID, reason))
+			case err == nil:
+				state = desiredState(action)
+				notify.Send(config.Notifications, "Garage door "+action,
+					fmt.Sprintf("Garage door %s is now %s for car %d because %s", door.MyQSerial, state, car.CarID, reason))
+			case !errors.Is(err, ErrTimeout) && !errors.Is(err, context.Canceled):
+				// a door that timed out has already been alerted on as stuck
+				notify.Send(config.Notifications, "Garage door "+action+" failed",
+					fmt.Sprintf("Couldn't %s garage door %s for car %d: %v", action, door.MyQSerial, car.CarID, err))
 			}
-			currentState = state
+			publish.LastAction(config, car.CarID, door.MyQSerial, action, state, err)
 		}
-		if currentState == desiredState {
-			break
+	}
+	car.Lock()
+	door.AtHome = !door.AtHome // toggle AtHome status
+	door.LastActionTime = time.Now()
+	door.LastAction = action
+	door.Confirmations, door.PendingSince = 0, time.Time{}
+	publishAtHome(config, car, door)
+	car.Unlock()
+}
+
+// track consecutive failures of the door's actions, disabling the door for circuit_breaker_cooldown once
+// they reach circuit_breaker_threshold so a down MyQ or wrong serial isn't retried on every trigger; once the
+// cooldown passes, the next action is attempted and a failure disables the door again. caller must hold the
+// car's lock
+func recordResult(config t.ConfigStruct, car *t.Car, door *t.GarageDoor, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrStateMismatch) {
+		return // shutting down, or a door that wasn't in a state to act on, isn't a failure of the door
+	}
+	if err == nil {
+		if door.Failures > 0 {
+			slog.Info("Garage door action succeeded, resetting circuit breaker", "car_id", car.CarID, "door_serial", door.MyQSerial)
 		}
-		time.Sleep(5 * time.Second)
+		door.Failures = 0
+		door.DisabledUntil = time.Time{}
+		return
+	}
+	door.Failures++
+	threshold := config.Global.BreakerThreshold
+	if threshold == 0 {
+		threshold = t.DefaultBreakerThreshold
+	}
+	if door.Failures < threshold {
+		return
 	}
+	cooldown := time.Duration(config.Global.BreakerCooldown)
+	if cooldown == 0 {
+		cooldown = t.DefaultBreakerCooldown
+	}
+	door.DisabledUntil = time.Now().Add(cooldown)
+	slog.Error("Disabling garage door after repeated failures", "car_id", car.CarID, "door_serial", door.MyQSerial,
+		"failures", door.Failures, "disabled_until", door.DisabledUntil, "error", err)
+}
 
-	if currentState != desiredState {
-		return fmt.Errorf("timed out waiting for door to be %s", desiredState)
+// open or close one of the car's garage doors on demand, outside of the geofence logic, and return the door's
+// resulting state; returns ErrDoorBusy if the door is already being operated. in dry run mode the action is only
+// logged. cancelling ctx stops waiting for the door
+func OperateGarageDoor(ctx context.Context, config t.ConfigStruct, car *t.Car, door *t.GarageDoor, action string) (string, error) {
+	car.Lock()
+	if door.OpLock {
+		car.Unlock()
+		return "", ErrDoorBusy
 	}
+	door.OpLock = true
+	car.Unlock()
+	defer func() {
+		car.Lock()
+		door.OpLock = false
+		car.Unlock()
+	}()
 
-	return nil
+	if config.DryRun {
+		slog.Info(fmt.Sprintf("DRY RUN - would %s garage door", action), "car_id", car.CarID, "door_serial", door.MyQSerial, "action", action, "reason", "manual")
+		return desiredState(action), nil
+	}
+	controller := controllerFor(config, car)
+	if err := setGarageDoor(ctx, config, controller, door.MyQSerial, action, door.ConfirmsStateChange()); err != nil {
+		return "", err
+	}
+	if config.Testing {
+		return desiredState(action), nil
+	}
+	return controller.State(door.MyQSerial)
 }
 
-func GetGarageDoorSerials(config t.ConfigStruct) error {
-	s := &myq.Session{}
-	s.Username = config.Global.MyQEmail
-	s.Password = config.Global.MyQPass
+// returns the state of a door moving as a result of the given action
+func transitionalState(action string) string {
+	switch action {
+	case garage.ActionOpen:
+		return garage.StateOpening
+	case garage.ActionClose:
+		return garage.StateClosing
+	}
+	return ""
+}
 
-	log.Println("Acquiring MyQ session...")
-	if err := s.Login(); err != nil {
-		log.SetOutput(os.Stderr)
-		log.Printf("ERROR: %v\n", err)
-		log.SetOutput(os.Stdout)
-		return err
+// returns the action that undoes the given action
+func oppositeAction(action string) string {
+	switch action {
+	case garage.ActionOpen:
+		return garage.ActionClose
+	case garage.ActionClose:
+		return garage.ActionOpen
 	}
-	log.Println("Session acquired...")
+	return ""
+}
 
-	devices, err := s.Devices()
+// returns the state a door must be in for the given action to change it
+func oppositeState(action string) string {
+	switch action {
+	case garage.ActionOpen:
+		return garage.StateClosed
+	case garage.ActionClose:
+		return garage.StateOpen
+	}
+	return ""
+}
+
+// returns the door state that results from the given action
+func desiredState(action string) string {
+	switch action {
+	case garage.ActionOpen:
+		return garage.StateOpen
+	case garage.ActionClose:
+		return garage.StateClosed
+	}
+	return ""
+}
+
+// returns how long to wait for a door to reach the desired state after acting, and how often to check it when
+// polling, from door_action_timeout and door_poll_interval if they're set
+func doorTimings(config t.ConfigStruct) (timeout time.Duration, interval time.Duration) {
+	timeout, interval = t.DefaultDoorActionTimeout, t.DefaultDoorPollInterval
+	if config.Global.DoorActionTimeout > 0 {
+		timeout = time.Duration(config.Global.DoorActionTimeout)
+	}
+	if config.Global.DoorPollInterval > 0 {
+		interval = time.Duration(config.Global.DoorPollInterval)
+	}
+	return timeout, interval
+}
+
+// open or close the door and, if confirm is set, wait for it to reach the desired state; if ctx is cancelled, the
+// action isn't issued if it hasn't been already, and waiting stops
+func setGarageDoor(ctx context.Context, config t.ConfigStruct, controller garage.GarageController, deviceSerial string, action string,
+	confirm bool) error {
+	desiredState := desiredState(action)
+
+	logger := slog.With("door_serial", deviceSerial, "action", action)
+
+	if config.Testing {
+		logger.Info("TESTING flag set - Would attempt action")
+		return nil
+	}
+
+	curState, err := controller.State(deviceSerial)
 	if err != nil {
-		log.Printf("Could not get devices: %v", err)
-		return err
+		logger.Error("Couldn't get device state", "error", err)
+		return fmt.Errorf("couldn't get door state: %w", err)
+	}
+
+	logger.Info("Checked current door state", "state", curState)
+	issueAction := true
+	switch curState {
+	case desiredState:
+		logger.Info("Door is already in the desired state", "state", curState)
+		return nil
+	case transitionalState(action):
+		// already moving toward the desired state, so wait for it rather than issuing the action again
+		logger.Info("Door is already moving toward the desired state", "state", curState)
+		issueAction = false
+	case oppositeState(action), garage.StateStopped:
+		// a door that stopped partway, e.g. after an obstruction, is retried
+	default:
+		// the door wasn't operated, so don't report it as having reached the desired state
+		logger.Warn("Action and state mismatch: garage state is not valid for executing requested action", "state", curState)
+		return fmt.Errorf("%w: door is %s", ErrStateMismatch, curState)
+	}
+
+	// watch for state changes before acting so that a fast transition isn't missed
+	var states <-chan string
+	if notifier, ok := controller.(garage.StateNotifier); ok && confirm {
+		var cancel func()
+		states, cancel = notifier.WatchState(deviceSerial)
+		defer cancel()
+	}
+
+	start := time.Now()
+	if issueAction {
+		if err := ctx.Err(); err != nil {
+			logger.Warn("Not attempting action, shutting down", "error", err)
+			return err
+		}
+		logger.Info("Attempting action")
+		if err := controller.SetState(deviceSerial, action); err != nil {
+			logger.Error("Unable to set door state", "error", err)
+			return fmt.Errorf("couldn't %s door: %w", action, err)
+		}
+	}
+	if !confirm {
+		logger.Info("Not waiting for door to " + action + ", confirm_state_change is disabled")
+		return nil
+	}
+	// if the door stops while moving, issue the action once more
+	retry := func() error {
+		logger.Warn("Door stopped before reaching the desired state, retrying action")
+		return controller.SetState(deviceSerial, action)
+	}
+
+	logger.Info("Waiting for door to " + action + "...")
+	timeout, interval := doorTimings(config)
+	if states != nil {
+		err = waitForState(ctx, logger, states, curState, desiredState, timeout, retry)
+	} else {
+		err = pollForState(ctx, logger, controller, deviceSerial, curState, desiredState, timeout, interval, retry)
 	}
-	for _, d := range devices {
-		log.Printf("Device Name: %v", d.Name)
-		log.Printf("Device State: %v", d.DoorState)
-		log.Printf("Device Type: %v", d.Type)
-		log.Printf("Device Serial: %v", d.SerialNumber)
-		fmt.Println()
+	var stuck *stuckDoorError
+	if errors.As(err, &stuck) {
+		alertStuckDoor(config, logger, deviceSerial, stuck)
 	}
+	if err != nil {
+		return err
+	}
+	logger.Info("Door reached desired state", "state", desiredState, "duration", time.Since(start).Round(time.Millisecond))
 
 	return nil
 }
+
+// returned when a door doesn't reach the desired state within door_action_timeout
+type stuckDoorError struct {
+	desiredState string
+	lastState    string // last state observed while waiting
+}
+
+func (e *stuckDoorError) Error() string {
+	return fmt.Sprintf("timed out waiting for door to be %s, last observed state was %s", e.desiredState, e.lastState)
+}
+
+func (e *stuckDoorError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// alert loudly that a door didn't reach the desired state, via notifications and mqtt, since e.g. an open door
+// that didn't close needs attention
+func alertStuckDoor(config t.ConfigStruct, logger *slog.Logger, deviceSerial string, stuck *stuckDoorError) {
+	logger.Error("Door didn't reach the desired state", "desired_state", stuck.desiredState, "state", stuck.lastState)
+	notify.Send(config.Notifications, "Garage door stuck",
+		fmt.Sprintf("Garage door %s didn't become %s, last observed state was %s", deviceSerial, stuck.desiredState, stuck.lastState))
+	publish.StuckDoor(config, deviceSerial, stuck.desiredState, stuck.lastState)
+}
+
+// wait for the controller to report the desired state, starting from curState and calling retry the first time
+// the door stops; used by controllers that push state changes
+func waitForState(ctx context.Context, logger *slog.Logger, states <-chan string, curState string, desiredState string, timeout time.Duration,
+	retry func() error) error {
+	deadline := time.After(timeout)
+	retried := false
+	for {
+		select {
+		case state := <-states:
+			logger.Info("Door state changed", "state", state)
+			curState = state
+			if state == desiredState {
+				return nil
+			}
+			if state == garage.StateStopped && !retried {
+				retried = true
+				if err := retry(); err != nil {
+					return err
+				}
+			}
+		case <-deadline:
+			return &stuckDoorError{desiredState: desiredState, lastState: curState}
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for door to be %s: %w", desiredState, ctx.Err())
+		}
+	}
+}
+
+// poll the controller until it reports the desired state, starting from currentState and calling retry the first
+// time the door stops; used by controllers that can't push state changes
+func pollForState(ctx context.Context, logger *slog.Logger, controller garage.GarageController, deviceSerial string, currentState string,
+	desiredState string, timeout time.Duration, interval time.Duration, retry func() error) error {
+	retried := false
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		state, err := controller.State(deviceSerial)
+		if err != nil {
+			return err
+		}
+		if state != currentState {
+			logger.Info("Door state changed", "state", state)
+			currentState = state
+		}
+		if currentState == desiredState {
+			return nil
+		}
+		if currentState == garage.StateStopped && !retried {
+			retried = true
+			if err := retry(); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for door to be %s: %w", desiredState, ctx.Err())
+		}
+	}
+	return &stuckDoorError{desiredState: desiredState, lastState: currentState}
+}
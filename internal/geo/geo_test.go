@@ -0,0 +1,538 @@
+package geo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"myq-teslamate-geofence/internal/garage"
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// returns true if got is within tolerance (a fraction, e.g. 0.005 for 0.5%) of want
+func near(got float64, want float64, tolerance float64) bool {
+	return math.Abs(got-want) <= want*tolerance
+}
+
+func TestToRadians(test *testing.T) {
+	cases := []struct {
+		degrees float64
+		want    float64
+	}{
+		{0, 0},
+		{90, math.Pi / 2},
+		{180, math.Pi},
+		{-180, -math.Pi},
+		{360, 2 * math.Pi},
+		{45, math.Pi / 4},
+	}
+	for _, c := range cases {
+		if got := toRadians(c.degrees); math.Abs(got-c.want) > 1e-12 {
+			test.Errorf("toRadians(%v) = %v, want %v", c.degrees, got, c.want)
+		}
+	}
+}
+
+func TestDistance(test *testing.T) {
+	cases := []struct {
+		name   string
+		point1 t.Point
+		point2 t.Point
+		want   float64 // meters
+	}{
+		{"london to paris", t.Point{Lat: 51.5074, Lng: -0.1278}, t.Point{Lat: 48.8566, Lng: 2.3522}, 343_500},
+		{"new york to los angeles", t.Point{Lat: 40.7128, Lng: -74.0060}, t.Point{Lat: 34.0522, Lng: -118.2437}, 3_936_000},
+		{"sydney to melbourne", t.Point{Lat: -33.8688, Lng: 151.2093}, t.Point{Lat: -37.8136, Lng: 144.9631}, 713_400},
+		// one degree of longitude along the equator, across the antimeridian
+		{"antimeridian", t.Point{Lat: 0, Lng: 179.5}, t.Point{Lat: 0, Lng: -179.5}, 111_195},
+		// one degree of latitude, passing over the north pole
+		{"over the pole", t.Point{Lat: 89.5, Lng: 0}, t.Point{Lat: 89.5, Lng: 180}, 111_195},
+		{"south pole to equator", t.Point{Lat: -90, Lng: 0}, t.Point{Lat: 0, Lng: 0}, 10_007_543},
+	}
+	for _, c := range cases {
+		got := distance(c.point1, c.point2)
+		if !near(got, c.want, 0.005) {
+			test.Errorf("%s: distance = %.0fm, want %.0fm ±0.5%%", c.name, got, c.want)
+		}
+		// distance is symmetric
+		if reverse := distance(c.point2, c.point1); math.Abs(reverse-got) > 1e-6 {
+			test.Errorf("%s: distance reversed = %.3fm, want %.3fm", c.name, reverse, got)
+		}
+	}
+}
+
+func TestDistanceZero(test *testing.T) {
+	for _, point := range []t.Point{{Lat: 48.858195, Lng: 2.294689}, {Lat: 0, Lng: 180}, {Lat: 90, Lng: 0}, {Lat: -45, Lng: -120}} {
+		if got := distance(point, point); got != 0 {
+			test.Errorf("distance from %v to itself = %vm, want 0", point, got)
+		}
+	}
+}
+
+func TestWithinGeofence(test *testing.T) {
+	center := t.Point{Lat: 48.858195, Lng: 2.294689}
+	onRadius := t.Point{Lat: 48.858195, Lng: 2.295689}
+	radius := t.Distance(distance(center, onRadius))
+	circle := t.Geofence{Center: center, Radius: radius}
+	square := t.Geofence{Polygon: []t.Point{
+		{Lat: 48.8580, Lng: 2.2940}, {Lat: 48.8590, Lng: 2.2940}, {Lat: 48.8590, Lng: 2.2950}, {Lat: 48.8580, Lng: 2.2950},
+	}}
+	minElevation, maxElevation := t.Distance(20), t.Distance(40)
+	banded := t.Geofence{Center: center, Radius: radius, MinElevation: &minElevation, MaxElevation: &maxElevation}
+	across := t.Geofence{Center: t.Point{Lat: 0, Lng: 179.9999}, Radius: 50}
+	pole := t.Geofence{Center: t.Point{Lat: 90, Lng: 0}, Radius: 1000}
+	elevation := func(e float64) *float64 { return &e }
+
+	cases := []struct {
+		name      string
+		point     t.Point
+		elevation *float64
+		geofence  t.Geofence
+		buffer    t.Distance
+		want      bool
+	}{
+		{"at the center", center, nil, circle, 0, true},
+		{"exactly on the radius", onRadius, nil, circle, 0, true},
+		{"just outside the radius", t.Point{Lat: 48.858195, Lng: 2.2957}, nil, circle, 0, false},
+		{"outside the radius within a positive buffer", t.Point{Lat: 48.858195, Lng: 2.2957}, nil, circle, 5, true},
+		{"on the radius with a negative buffer", onRadius, nil, circle, -5, false},
+		{"far away", t.Point{Lat: 51.5074, Lng: -0.1278}, nil, circle, 0, false},
+		{"inside a polygon", t.Point{Lat: 48.8585, Lng: 2.2945}, nil, square, 0, true},
+		{"outside a polygon", t.Point{Lat: 48.8595, Lng: 2.2945}, nil, square, 0, false},
+		{"just outside a polygon", t.Point{Lat: 48.85903, Lng: 2.2945}, nil, square, 0, false},
+		{"just outside a polygon within a positive buffer", t.Point{Lat: 48.85903, Lng: 2.2945}, nil, square, 5, true},
+		{"outside a polygon beyond a positive buffer", t.Point{Lat: 48.8595, Lng: 2.2945}, nil, square, 5, false},
+		{"just inside a polygon", t.Point{Lat: 48.85897, Lng: 2.2945}, nil, square, 0, true},
+		{"just inside a polygon within a negative buffer", t.Point{Lat: 48.85897, Lng: 2.2945}, nil, square, -5, false},
+		{"inside a polygon beyond a negative buffer", t.Point{Lat: 48.8585, Lng: 2.2945}, nil, square, -5, true},
+		{"within the elevation band", center, elevation(30), banded, 0, true},
+		{"below the elevation band", center, elevation(10), banded, 0, false},
+		{"above the elevation band", center, elevation(50), banded, 0, false},
+		{"unknown elevation ignores the band", center, nil, banded, 0, true},
+		{"across the antimeridian", t.Point{Lat: 0, Lng: -179.9999}, nil, across, 0, true},
+		{"near the pole on the far side", t.Point{Lat: 89.995, Lng: 180}, nil, pole, 0, true},
+	}
+	measure := distanceModel(t.ConfigStruct{})
+	for _, c := range cases {
+		if got := withinGeofence(measure, c.point, c.elevation, c.geofence, c.buffer); got != c.want {
+			test.Errorf("%s: withinGeofence = %t, want %t", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDistanceModels(test *testing.T) {
+	// vincenty's own test line from Flinders Peak to Buninyong, in degrees, minutes, and seconds
+	flindersPeak := t.Point{Lat: -(37 + 57.0/60 + 3.72030/3600), Lng: 144 + 25.0/60 + 29.52440/3600}
+	buninyong := t.Point{Lat: -(37 + 39.0/60 + 10.15610/3600), Lng: 143 + 55.0/60 + 35.38390/3600}
+	cases := []struct {
+		name          string
+		point1        t.Point
+		point2        t.Point
+		wantHaversine float64 // meters on a sphere with a radius of 6371km
+		wantVincenty  float64 // meters on the WGS-84 ellipsoid
+	}{
+		{"flinders peak to buninyong", flindersPeak, buninyong, 54_925.432, 54_972.271},
+		{"one degree along the equator", t.Point{Lat: 0, Lng: 0}, t.Point{Lat: 0, Lng: 1}, 111_194.927, 111_319.491},
+		{"one degree north from the equator", t.Point{Lat: 0, Lng: 0}, t.Point{Lat: 1, Lng: 0}, 111_194.927, 110_574.389},
+		{"equator to the north pole", t.Point{Lat: 0, Lng: 0}, t.Point{Lat: 90, Lng: 0}, 10_007_543.398, 10_001_965.729},
+	}
+	for _, c := range cases {
+		if got := distance(c.point1, c.point2); math.Abs(got-c.wantHaversine) > 0.01 {
+			test.Errorf("%s: haversine = %.3fm, want %.3fm", c.name, got, c.wantHaversine)
+		}
+		if got := vincentyDistance(c.point1, c.point2); math.Abs(got-c.wantVincenty) > 0.01 {
+			test.Errorf("%s: vincenty = %.3fm, want %.3fm", c.name, got, c.wantVincenty)
+		}
+	}
+
+	if got := vincentyDistance(flindersPeak, flindersPeak); got != 0 {
+		test.Errorf("vincenty from a point to itself = %vm, want 0", got)
+	}
+	// vincenty's formula doesn't converge for nearly antipodal points, so haversine is used instead
+	antipode := t.Point{Lat: 0.5, Lng: 179.7}
+	if got, want := vincentyDistance(t.Point{}, antipode), distance(t.Point{}, antipode); got != want {
+		test.Errorf("vincenty for nearly antipodal points = %.3fm, want the haversine distance %.3fm", got, want)
+	}
+}
+
+func TestDistanceModel(test *testing.T) {
+	point1, point2 := t.Point{Lat: 0, Lng: 0}, t.Point{Lat: 0, Lng: 1}
+	for model, want := range map[string]float64{
+		"":                       distance(point1, point2),
+		t.DistanceModelHaversine: distance(point1, point2),
+		t.DistanceModelVincenty:  vincentyDistance(point1, point2),
+	} {
+		var config t.ConfigStruct
+		config.Global.DistanceModel = model
+		if got := distanceModel(config)(point1, point2); got != want {
+			test.Errorf("distance_model %q: distance = %.3fm, want %.3fm", model, got, want)
+		}
+	}
+}
+
+// a garage.GarageController that records each call and returns scripted states instead of operating a door
+type fakeController struct {
+	sync.Mutex
+	states map[string][]string // states returned for each serial in order; the last one repeats
+	calls  []string
+}
+
+func (f *fakeController) State(serial string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, "State "+serial)
+	states, ok := f.states[serial]
+	if !ok {
+		return "", fmt.Errorf("device %s not found", serial)
+	}
+	state := states[0]
+	if len(states) > 1 {
+		f.states[serial] = states[1:]
+	}
+	return state, nil
+}
+
+func (f *fakeController) SetState(serial string, action string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, "SetState "+serial+" "+action)
+	if len(f.states[serial]) == 1 {
+		// once the scripted states have run out, the door does as it's told
+		f.states[serial] = []string{desiredState(action)}
+	}
+	return nil
+}
+
+// returns the actions taken so far
+func (f *fakeController) taken() []string {
+	f.Lock()
+	defer f.Unlock()
+	var actions []string
+	for _, call := range f.calls {
+		if action, ok := strings.CutPrefix(call, "SetState serial "); ok {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// install a fake controller for all cars with the door in the given state, restoring controllerFor when the test
+// finishes
+func useFakeController(test *testing.T, state string) *fakeController {
+	controller := &fakeController{states: map[string][]string{"serial": {state}}}
+	original := controllerFor
+	controllerFor = func(config t.ConfigStruct, car *t.Car) garage.GarageController { return controller }
+	test.Cleanup(func() { controllerFor = original })
+	return controller
+}
+
+// returns a config that checks doors without waiting between checks
+func testConfig() t.ConfigStruct {
+	var config t.ConfigStruct
+	config.Global.DoorPollInterval = t.Duration(time.Millisecond)
+	return config
+}
+
+func TestSetGarageDoor(test *testing.T) {
+	cases := []struct {
+		name      string
+		action    string
+		states    []string
+		wantCalls []string
+		wantErr   bool
+	}{
+		{"open a closed door", garage.ActionOpen, []string{garage.StateClosed},
+			[]string{"State serial", "SetState serial open", "State serial"}, false},
+		{"close an open door", garage.ActionClose, []string{garage.StateOpen},
+			[]string{"State serial", "SetState serial close", "State serial"}, false},
+		{"open an open door", garage.ActionOpen, []string{garage.StateOpen},
+			[]string{"State serial"}, false},
+		{"close a closed door", garage.ActionClose, []string{garage.StateClosed},
+			[]string{"State serial"}, false},
+		{"open a door in an unknown state", garage.ActionOpen, []string{garage.StateUnknown},
+			[]string{"State serial"}, true},
+		{"close a door in an unknown state", garage.ActionClose, []string{garage.StateUnknown},
+			[]string{"State serial"}, true},
+		{"poll until the door is open", garage.ActionOpen, []string{garage.StateClosed, garage.StateOpening, garage.StateOpening, garage.StateOpen},
+			[]string{"State serial", "SetState serial open", "State serial", "State serial", "State serial"}, false},
+		{"poll until the door is closed", garage.ActionClose, []string{garage.StateOpen, garage.StateClosing, garage.StateClosed},
+			[]string{"State serial", "SetState serial close", "State serial", "State serial"}, false},
+		{"wait for a door that's already opening", garage.ActionOpen, []string{garage.StateOpening, garage.StateOpen},
+			[]string{"State serial", "State serial"}, false},
+		{"close a stopped door", garage.ActionClose, []string{garage.StateStopped},
+			[]string{"State serial", "SetState serial close", "State serial"}, false},
+		{"retry once if the door stops", garage.ActionOpen, []string{garage.StateClosed, garage.StateOpening, garage.StateStopped},
+			[]string{"State serial", "SetState serial open", "State serial", "State serial", "SetState serial open", "State serial"}, false},
+		{"open a closing door", garage.ActionOpen, []string{garage.StateClosing},
+			[]string{"State serial"}, true},
+	}
+	for _, c := range cases {
+		controller := &fakeController{states: map[string][]string{"serial": c.states}}
+		err := setGarageDoor(context.Background(), testConfig(), controller, "serial", c.action, true)
+		if (err != nil) != c.wantErr {
+			test.Errorf("%s: setGarageDoor = %v, want error %t", c.name, err, c.wantErr)
+		}
+		if !reflect.DeepEqual(controller.calls, c.wantCalls) {
+			test.Errorf("%s: calls = %q, want %q", c.name, controller.calls, c.wantCalls)
+		}
+	}
+}
+
+func TestSetGarageDoorStateError(test *testing.T) {
+	controller := &fakeController{states: map[string][]string{}}
+
+	// a door that can't be read isn't operated
+	if err := setGarageDoor(context.Background(), testConfig(), controller, "missing", garage.ActionOpen, true); err == nil {
+		test.Error("setGarageDoor for a missing door = nil, want the error")
+	}
+	if want := []string{"State missing"}; !reflect.DeepEqual(controller.calls, want) {
+		test.Errorf("calls = %q, want %q", controller.calls, want)
+	}
+}
+
+func TestSetGarageDoorTesting(test *testing.T) {
+	controller := &fakeController{states: map[string][]string{"serial": {garage.StateClosed}}}
+	config := testConfig()
+	config.Testing = true
+
+	if err := setGarageDoor(context.Background(), config, controller, "serial", garage.ActionOpen, true); err != nil {
+		test.Errorf("setGarageDoor while testing = %v, want nil", err)
+	}
+	if len(controller.calls) != 0 {
+		test.Errorf("calls while testing = %q, want none", controller.calls)
+	}
+}
+
+func TestSetGarageDoorWithoutConfirm(test *testing.T) {
+	controller := &fakeController{states: map[string][]string{"serial": {garage.StateClosed, garage.StateClosed}}}
+
+	// the door's state isn't checked again after the command is sent
+	if err := setGarageDoor(context.Background(), testConfig(), controller, "serial", garage.ActionOpen, false); err != nil {
+		test.Errorf("setGarageDoor without confirming = %v, want nil", err)
+	}
+	want := []string{"State serial", "SetState serial open"}
+	if !reflect.DeepEqual(controller.calls, want) {
+		test.Errorf("calls = %q, want %q", controller.calls, want)
+	}
+}
+
+var (
+	home    = t.Point{Lat: 48.858195, Lng: 2.294689}
+	between = t.Point{Lat: 48.858195, Lng: 2.295689} // about 73m from home, inside the close geofence but outside the open one
+	away    = t.Point{Lat: 48.868195, Lng: 2.294689} // about 1.1km from home
+)
+
+// returns a config that polls doors quickly, and a car with one door that opens within 50m of home and closes
+// beyond 100m
+func testCar() (t.ConfigStruct, *t.Car) {
+	var config t.ConfigStruct
+	config.Global.DoorPollInterval = t.Duration(time.Millisecond)
+	config.Global.DoorActionTimeout = t.Duration(time.Second)
+	door := &t.GarageDoor{
+		MyQSerial:      "serial",
+		GarageCloseGeo: t.Geofence{Center: home, Radius: 100},
+		GarageOpenGeo:  t.Geofence{Center: home, Radius: 50},
+		DoorState:      &t.DoorState{},
+	}
+	return config, &t.Car{CarID: 1, GarageDoors: []*t.GarageDoor{door}, CarState: &t.CarState{}}
+}
+
+// move the car to point and check its geofences
+func moveTo(config t.ConfigStruct, car *t.Car, point t.Point) {
+	car.Lock()
+	car.CurLat, car.CurLng = point.Lat, point.Lng
+	position := car.Position()
+	car.Unlock()
+	CheckGeoFence(context.Background(), config, car, position)
+}
+
+func TestCheckGeoFence(test *testing.T) {
+	controller := useFakeController(test, garage.StateOpen)
+	config, car := testCar()
+	door := car.GarageDoors[0]
+
+	steps := []struct {
+		name       string
+		point      t.Point
+		wantAtHome bool
+		wantTaken  []string
+	}{
+		{"first position only initializes", home, true, nil},
+		{"staying home", home, true, nil},
+		{"leaving past the open geofence", between, true, nil},
+		{"leaving past the close geofence", away, false, []string{garage.ActionClose}},
+		{"staying away", away, false, []string{garage.ActionClose}},
+		{"returning past the close geofence", between, false, []string{garage.ActionClose}},
+		{"returning past the open geofence", home, true, []string{garage.ActionClose, garage.ActionOpen}},
+	}
+	for _, step := range steps {
+		moveTo(config, car, step.point)
+		car.Lock()
+		atHome, opLock := door.AtHome, door.OpLock
+		car.Unlock()
+		if atHome != step.wantAtHome {
+			test.Errorf("%s: AtHome = %t, want %t", step.name, atHome, step.wantAtHome)
+		}
+		if opLock {
+			test.Errorf("%s: OpLock still held after the check", step.name)
+		}
+		if taken := controller.taken(); !reflect.DeepEqual(taken, step.wantTaken) {
+			test.Errorf("%s: actions = %q, want %q", step.name, taken, step.wantTaken)
+		}
+	}
+	if state, _ := controller.State("serial"); state != garage.StateOpen {
+		test.Errorf("door is %s, want %s", state, garage.StateOpen)
+	}
+}
+
+func TestCheckGeoFenceNoAction(test *testing.T) {
+	controller := useFakeController(test, garage.StateClosed)
+	config, car := testCar()
+	door := car.GarageDoors[0]
+
+	// a car that starts out away and never enters the open geofence never operates the door
+	for _, point := range []t.Point{away, away, between, away} {
+		moveTo(config, car, point)
+	}
+	if taken := controller.taken(); len(taken) != 0 {
+		test.Errorf("actions = %q, want none", taken)
+	}
+	if !door.Initialized || door.AtHome {
+		test.Errorf("Initialized, AtHome = %t, %t, want true, false", door.Initialized, door.AtHome)
+	}
+}
+
+func TestCheckGeoFenceZeroPosition(test *testing.T) {
+	controller := useFakeController(test, garage.StateClosed)
+	config, car := testCar()
+	door := car.GarageDoors[0]
+
+	// a coordinate of 0 hasn't been received, so the position isn't checked at all
+	for _, point := range []t.Point{{Lat: home.Lat}, {Lng: home.Lng}, {}} {
+		moveTo(config, car, point)
+		if door.Initialized {
+			test.Fatalf("door initialized from position %v, want it ignored", point)
+		}
+	}
+	moveTo(config, car, away)
+	moveTo(config, car, t.Point{Lat: home.Lat})
+	if taken := controller.taken(); len(taken) != 0 {
+		test.Errorf("actions = %q, want none", taken)
+	}
+	if !door.Initialized || door.AtHome {
+		test.Errorf("Initialized, AtHome = %t, %t, want true, false", door.Initialized, door.AtHome)
+	}
+}
+
+func TestCheckGeoFenceOpLock(test *testing.T) {
+	controller := useFakeController(test, garage.StateOpen)
+	config, car := testCar()
+	door := car.GarageDoors[0]
+
+	moveTo(config, car, home)
+	// while another action holds the door, the car leaving is ignored
+	car.Lock()
+	door.OpLock = true
+	car.Unlock()
+	moveTo(config, car, away)
+	if taken := controller.taken(); len(taken) != 0 {
+		test.Errorf("actions while op locked = %q, want none", taken)
+	}
+	if !door.AtHome {
+		test.Error("AtHome = false while op locked, want it unchanged")
+	}
+
+	// OperateGarageDoor won't operate the door either
+	if _, err := OperateGarageDoor(context.Background(), config, car, door, garage.ActionClose); !errors.Is(err, ErrDoorBusy) {
+		test.Errorf("OperateGarageDoor while op locked = %v, want ErrDoorBusy", err)
+	}
+
+	car.Lock()
+	door.OpLock = false
+	car.Unlock()
+	moveTo(config, car, away)
+	if taken := controller.taken(); !reflect.DeepEqual(taken, []string{garage.ActionClose}) {
+		test.Errorf("actions once the lock is released = %q, want %q", taken, []string{garage.ActionClose})
+	}
+}
+
+func TestCheckGeoFenceQueuedPosition(test *testing.T) {
+	controller := useFakeController(test, garage.StateOpen)
+	config, car := testCar()
+	door := car.GarageDoors[0]
+
+	moveTo(config, car, home)
+	// a check queued when the car left is still evaluated at that position after the car has returned
+	car.Lock()
+	car.CurLat, car.CurLng = away.Lat, away.Lng
+	left := car.Position()
+	car.CurLat, car.CurLng = home.Lat, home.Lng
+	car.Unlock()
+	CheckGeoFence(context.Background(), config, car, left)
+	if taken := controller.taken(); !reflect.DeepEqual(taken, []string{garage.ActionClose}) {
+		test.Errorf("actions = %q, want %q", taken, []string{garage.ActionClose})
+	}
+	if door.AtHome {
+		test.Error("AtHome = true after checking the queued position, want false")
+	}
+}
+
+func TestCheckGeoFenceCooldown(test *testing.T) {
+	controller := useFakeController(test, garage.StateOpen)
+	config, car := testCar()
+	config.Global.OpCooldown = t.MinuteDuration(time.Minute)
+	door := car.GarageDoors[0]
+
+	moveTo(config, car, home)
+	moveTo(config, car, away)
+	// turning straight back is ignored during the cooldown from closing, and reported once
+	moveTo(config, car, home)
+	moveTo(config, car, home)
+	if taken := controller.taken(); !reflect.DeepEqual(taken, []string{garage.ActionClose}) {
+		test.Errorf("actions during the cooldown = %q, want %q", taken, []string{garage.ActionClose})
+	}
+	if door.AtHome || door.CooldownSkipped != garage.ActionOpen {
+		test.Errorf("AtHome, CooldownSkipped = %t, %q, want false, %q", door.AtHome, door.CooldownSkipped, garage.ActionOpen)
+	}
+
+	// once the cooldown has passed the door opens
+	car.Lock()
+	door.LastActionTime = time.Now().Add(-2 * time.Minute)
+	car.Unlock()
+	moveTo(config, car, home)
+	want := []string{garage.ActionClose, garage.ActionOpen}
+	if taken := controller.taken(); !reflect.DeepEqual(taken, want) {
+		test.Errorf("actions after the cooldown = %q, want %q", taken, want)
+	}
+	if !door.AtHome || door.CooldownSkipped != "" {
+		test.Errorf("AtHome, CooldownSkipped = %t, %q, want true, \"\"", door.AtHome, door.CooldownSkipped)
+	}
+}
+
+func TestOperateGarageDoor(test *testing.T) {
+	controller := useFakeController(test, garage.StateClosed)
+	config, car := testCar()
+	door := car.GarageDoors[0]
+
+	if state, err := OperateGarageDoor(context.Background(), config, car, door, garage.ActionOpen); err != nil || state != garage.StateOpen {
+		test.Errorf("OperateGarageDoor = %q, %v, want %q, nil", state, err, garage.StateOpen)
+	}
+	if door.OpLock {
+		test.Error("OpLock still held after OperateGarageDoor")
+	}
+
+	// in dry run mode the door isn't operated
+	config.DryRun = true
+	if state, err := OperateGarageDoor(context.Background(), config, car, door, garage.ActionClose); err != nil || state != garage.StateClosed {
+		test.Errorf("OperateGarageDoor in dry run = %q, %v, want %q, nil", state, err, garage.StateClosed)
+	}
+	if taken := controller.taken(); !reflect.DeepEqual(taken, []string{garage.ActionOpen}) {
+		test.Errorf("actions = %q, want %q", taken, []string{garage.ActionOpen})
+	}
+}
@@ -0,0 +1,103 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// a configured geofence and a description of where it's from, for overlap warnings
+type namedGeofence struct {
+	serial   string
+	name     string
+	geofence t.Geofence
+}
+
+// returns a warning for each pair of geofences belonging to different garage doors that overlap, since a car
+// in both could operate both doors at once. circles are compared exactly; polygons are compared by their
+// bounding boxes, so their warnings may be false positives, as may those of geofences made up of others
+func OverlapWarnings(config t.ConfigStruct) []string {
+	// a door shared by several cars is only checked once, using the first car's geofences; disabled cars can't
+	// operate doors, so they're skipped
+	var geofences []namedGeofence
+	seen := map[string]bool{}
+	for _, car := range config.Cars {
+		if car.TriggerOnGeofenceName != "" || !car.IsEnabled() {
+			continue
+		}
+		for _, door := range car.GarageDoors {
+			if seen[door.MyQSerial] {
+				continue
+			}
+			seen[door.MyQSerial] = true
+			// an undefined geofence falls back to the other one, so only the defined ones need checking
+			for _, kind := range []string{"open", "close"} {
+				geofence := door.GarageOpenGeo
+				if kind == "close" {
+					geofence = door.GarageCloseGeo
+				}
+				if !geofence.Defined() {
+					continue
+				}
+				geofences = append(geofences, namedGeofence{
+					serial:   door.MyQSerial,
+					name:     fmt.Sprintf("car %d door %s %s geofence", car.CarID, door.MyQSerial, kind),
+					geofence: geofence,
+				})
+			}
+		}
+	}
+
+	var warnings []string
+	measure := distanceModel(config)
+	for i, a := range geofences {
+		for _, b := range geofences[i+1:] {
+			if a.serial == b.serial || !overlaps(measure, a.geofence, b.geofence) {
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("%s overlaps %s", a.name, b.name))
+		}
+	}
+	return warnings
+}
+
+// returns true if the geofences overlap; exact for two circles, and by bounding box if either is a polygon. a
+// geofence made up of other geofences overlaps if any of them do, even if it only matches where all of them do
+func overlaps(measure distanceFunc, a t.Geofence, b t.Geofence) bool {
+	if len(a.Geofences) > 0 || len(b.Geofences) > 0 {
+		if len(a.Geofences) == 0 {
+			a, b = b, a
+		}
+		for _, g := range a.Geofences {
+			if overlaps(measure, g, b) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(a.Polygon) == 0 && len(b.Polygon) == 0 {
+		return measure(a.Center, b.Center) < float64(a.Radius+b.Radius)
+	}
+	minA, maxA := boundingBox(a)
+	minB, maxB := boundingBox(b)
+	return minA.Lat <= maxB.Lat && minB.Lat <= maxA.Lat && minA.Lng <= maxB.Lng && minB.Lng <= maxA.Lng
+}
+
+// returns the southwest and northeast corners of the box enclosing the geofence
+func boundingBox(geofence t.Geofence) (min t.Point, max t.Point) {
+	if len(geofence.Polygon) == 0 {
+		// meters per degree of latitude, and of longitude at the center's latitude
+		const metersPerDegree = 111320
+		latDelta := float64(geofence.Radius) / metersPerDegree
+		lngDelta := float64(geofence.Radius) / (metersPerDegree * math.Cos(toRadians(geofence.Center.Lat)))
+		return t.Point{Lat: geofence.Center.Lat - latDelta, Lng: geofence.Center.Lng - lngDelta},
+			t.Point{Lat: geofence.Center.Lat + latDelta, Lng: geofence.Center.Lng + lngDelta}
+	}
+	min, max = geofence.Polygon[0], geofence.Polygon[0]
+	for _, point := range geofence.Polygon[1:] {
+		min.Lat, min.Lng = math.Min(min.Lat, point.Lat), math.Min(min.Lng, point.Lng)
+		max.Lat, max.Lng = math.Max(max.Lat, point.Lat), math.Max(max.Lng, point.Lng)
+	}
+	return min, max
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/joeshaw/myq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	DoorActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "garage_door_actions_total",
+		Help: "Number of garage door actions triggered by a car's geofence",
+	}, []string{"car", "action"})
+
+	DoorActionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "garage_door_action_failures_total",
+		Help: "Number of failed garage door actions triggered by a car's geofence, by reason (auth, device_not_found, timeout, state_mismatch, canceled, or other)",
+	}, []string{"car", "action", "reason"})
+
+	DoorActionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "door_action_duration_seconds",
+		Help:    "Seconds from receiving the position that triggered a garage door action to the door reaching the desired state",
+		Buckets: []float64{2, 5, 10, 15, 20, 30, 45, 60, 90, 120, 180},
+	}, []string{"car", "action"})
+
+	MyQAPIErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myq_api_errors_total",
+		Help: "Number of failed calls to the MyQ API",
+	})
+
+	AutomationEnabled = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "geofence_automation_enabled",
+		Help: "Whether geofences operate garage doors (1) or are paused by the control topic (0)",
+	})
+
+	DoorState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "garage_door_state",
+		Help: "Last known state of the garage door (1 = open, 0 = closed, -1 = other)",
+	}, []string{"serial"})
+)
+
+// record the last known state of a garage door
+func SetDoorState(serial string, state string) {
+	var value float64
+	switch state {
+	case myq.StateOpen:
+		value = 1
+	case myq.StateClosed:
+		value = 0
+	default:
+		value = -1
+	}
+	DoorState.WithLabelValues(serial).Set(value)
+}
@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+const (
+	ProviderNtfy   = "ntfy"
+	ProviderGotify = "gotify"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+type notifier interface {
+	send(title string, message string) error
+}
+
+// posts the message to an ntfy topic url
+type ntfy struct {
+	url   string
+	token string
+}
+
+// posts the message to a gotify server's message api
+type gotify struct {
+	url   string
+	token string
+}
+
+func (n ntfy) send(title string, message string) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, strings.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", title)
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	return do(req)
+}
+
+func (g gotify) send(title string, message string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    title,
+		"message":  message,
+		"priority": 5,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(g.url, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.token)
+	return do(req)
+}
+
+func do(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("received HTTP status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func newNotifier(config t.Notifications) notifier {
+	switch config.Provider {
+	case ProviderNtfy:
+		return ntfy{url: config.URL, token: config.Token}
+	case ProviderGotify:
+		return gotify{url: config.URL, token: config.Token}
+	}
+	return nil
+}
+
+// send a notification via the configured provider in the background; failures are logged
+// but never returned so that notifications can't block or fail a door action
+func Send(config t.Notifications, title string, message string) {
+	n := newNotifier(config)
+	if n == nil {
+		return // notifications not configured
+	}
+	go func() {
+		if err := n.send(title, message); err != nil {
+			slog.Warn("Unable to send notification", "provider", config.Provider, "error", err)
+		}
+	}()
+}
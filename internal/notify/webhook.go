@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// events posted to webhooks when a car crosses a garage door's geofence
+const (
+	EventEntered = "entered"
+	EventExited  = "exited"
+)
+
+// number of times to try posting an event to a webhook, and how long to wait before the first retry,
+// doubled for each subsequent retry
+const (
+	webhookAttempts = 3
+	webhookBackoff  = 2 * time.Second
+)
+
+// json body posted to webhooks
+type Event struct {
+	CarID      int       `json:"car_id"`
+	DoorSerial string    `json:"door_serial"`
+	Event      string    `json:"event"`
+	Lat        float64   `json:"lat"`
+	Lng        float64   `json:"lng"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// post the event to each configured webhook in the background, retrying failures; failures are logged but
+// never returned so that webhooks can't block or fail a door action
+func Webhook(webhooks []t.Webhook, event Event) {
+	if len(webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Warn("Unable to encode webhook event", "car_id", event.CarID, "error", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		go func(url string) {
+			backoff := webhookBackoff
+			for attempt := 1; ; attempt++ {
+				err := postWebhook(url, body)
+				if err == nil {
+					return
+				}
+				if attempt == webhookAttempts {
+					slog.Warn("Unable to send webhook", "car_id", event.CarID, "door_serial", event.DoorSerial, "url", url, "error", err)
+					return
+				}
+				slog.Debug("Webhook failed, retrying", "car_id", event.CarID, "door_serial", event.DoorSerial, "url", url, "error", err,
+					"delay", backoff, "attempt", attempt, "max_attempts", webhookAttempts)
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}(webhook.URL)
+	}
+}
+
+func postWebhook(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req)
+}
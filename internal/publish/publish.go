@@ -0,0 +1,264 @@
+package publish
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// prefix of the topics this app publishes to, unless mqtt_publish_prefix is set
+const defaultPrefix = "myq-geofence"
+
+// mqtt client used to publish; nil until SetClient is called
+var client struct {
+	sync.Mutex
+	c mqtt.Client
+}
+
+// set the mqtt client used to publish
+func SetClient(c mqtt.Client) {
+	client.Lock()
+	defer client.Unlock()
+	client.c = c
+}
+
+// returns the topic under the configured publish prefix
+func topic(config t.ConfigStruct, format string, a ...interface{}) string {
+	prefix := config.Global.MqttPublishPrefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return prefix + "/" + fmt.Sprintf(format, a...)
+}
+
+// returns the configured qos for subscribing to teslamate's topics and publishing
+func QoS(config t.ConfigStruct) byte {
+	return byte(config.Global.MqttQoS)
+}
+
+// returns the qos for topics that carry commands, which is at least 1 so that commands aren't dropped
+func CommandQoS(config t.ConfigStruct) byte {
+	return max(QoS(config), 1)
+}
+
+// publish payload to the topic in the background with the configured qos; failures are only logged
+func publish(config t.ConfigStruct, topic string, retained bool, payload string) {
+	client.Lock()
+	c := client.c
+	client.Unlock()
+	if c == nil {
+		return
+	}
+
+	token := c.Publish(topic, QoS(config), retained, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			slog.Warn("Could not publish to MQTT topic", "topic", topic, "error", token.Error())
+		}
+	}()
+}
+
+// publish the distance in meters from the car to the center of the door's geofence
+func Distance(config t.ConfigStruct, carID int, serial string, meters float64) {
+	publish(config, topic(config, "cars/%d/%s/distance", carID, serial), false, strconv.FormatFloat(meters, 'f', 1, 64))
+}
+
+// publish the seconds left in the door's cooldown when a crossing is ignored because of it
+func CooldownRemaining(config t.ConfigStruct, carID int, serial string, remaining time.Duration) {
+	publish(config, topic(config, "cars/%d/%s/cooldown_remaining", carID, serial), false, strconv.FormatFloat(remaining.Seconds(), 'f', 0, 64))
+}
+
+// result of the last garage door action triggered by a car's geofence
+type lastAction struct {
+	Serial    string    `json:"serial"`
+	Action    string    `json:"action"`
+	Timestamp time.Time `json:"timestamp"`
+	State     string    `json:"state,omitempty"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// publish the result of a garage door action as a retained json message, so that subscribers such as
+// home assistant receive the latest action even if they connect later
+func LastAction(config t.ConfigStruct, carID int, serial string, action string, state string, err error) {
+	result := lastAction{
+		Serial:    serial,
+		Action:    action,
+		Timestamp: time.Now(),
+		State:     state,
+		Success:   err == nil,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	payload, _ := json.Marshal(result)
+	publish(config, topic(config, "cars/%d/last_action", carID), true, string(payload))
+}
+
+// returns the topic that the app's availability is published to
+func AvailabilityTopic(config t.ConfigStruct) string {
+	if config.Global.AvailabilityTopic != "" {
+		return config.Global.AvailabilityTopic
+	}
+	return topic(config, "availability")
+}
+
+// publish whether the app is online as a retained message; the broker publishes offline for us if the
+// connection is lost unexpectedly, since it's set as the client's last will
+func Availability(config t.ConfigStruct, online bool) {
+	payload := "offline"
+	if online {
+		payload = "online"
+	}
+	publish(config, AvailabilityTopic(config), true, payload)
+}
+
+// returns the topic that pauses and resumes geofence automation
+func ControlTopic(config t.ConfigStruct) string {
+	if config.Global.ControlTopic != "" {
+		return config.Global.ControlTopic
+	}
+	return topic(config, "control/enabled")
+}
+
+// publish whether geofence automation is enabled or paused as a retained message
+func Automation(config t.ConfigStruct, enabled bool) {
+	payload := "paused"
+	if enabled {
+		payload = "enabled"
+	}
+	publish(config, topic(config, "automation"), true, payload)
+}
+
+// publish whether the car is home as far as the door is concerned, as a retained ON or OFF
+func AtHome(config t.ConfigStruct, carID int, serial string, atHome bool) {
+	payload := "OFF"
+	if atHome {
+		payload = "ON"
+	}
+	publish(config, topic(config, "cars/%d/%s/at_home", carID, serial), true, payload)
+}
+
+// publish whether the car is home as a retained true or false, for automations that don't need per door states
+func CarHome(config t.ConfigStruct, carID int, home bool) {
+	publish(config, topic(config, "cars/%d/home", carID), true, strconv.FormatBool(home))
+}
+
+// publish the latest state read from a door, e.g. open or closed, as a retained message
+func DoorState(config t.ConfigStruct, serial string, state string) {
+	publish(config, doorTopic(config, serial, "state"), true, state)
+}
+
+// alert published when a door doesn't reach the desired state after an action
+type stuckDoor struct {
+	Serial       string    `json:"serial"`
+	DesiredState string    `json:"desired_state"`
+	LastState    string    `json:"last_state"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// publish an alert that a door timed out waiting to reach the desired state as json to <prefix>/doors/<serial>/alert;
+// it isn't retained so that an old alert isn't replayed to new subscribers
+func StuckDoor(config t.ConfigStruct, serial string, desiredState string, lastState string) {
+	payload, _ := json.Marshal(stuckDoor{Serial: serial, DesiredState: desiredState, LastState: lastState, Timestamp: time.Now()})
+	publish(config, doorTopic(config, serial, "alert"), false, string(payload))
+}
+
+// returns the topic of a door's field, e.g. its state or set command
+func doorTopic(config t.ConfigStruct, serial string, field string) string {
+	return topic(config, "doors/%s/%s", serial, field)
+}
+
+// returns the wildcard topic that home assistant publishes door commands to
+func DoorCommandTopic(config t.ConfigStruct) string {
+	return doorTopic(config, "+", "set")
+}
+
+// returns the serial of the door a command topic is for, or false if the topic isn't a door command topic
+func DoorCommandSerial(config t.ConfigStruct, commandTopic string) (string, bool) {
+	prefix, suffix := topic(config, "doors/"), "/set"
+	if !strings.HasPrefix(commandTopic, prefix) || !strings.HasSuffix(commandTopic, suffix) {
+		return "", false
+	}
+	serial := strings.TrimSuffix(strings.TrimPrefix(commandTopic, prefix), suffix)
+	return serial, serial != "" && !strings.Contains(serial, "/")
+}
+
+// characters that aren't allowed in home assistant discovery object ids
+var objectIDRegex = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// home assistant mqtt discovery config for an entity
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	DeviceClass       string          `json:"device_class"`
+	StateTopic        string          `json:"state_topic"`
+	CommandTopic      string          `json:"command_topic,omitempty"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	PayloadOn         string          `json:"payload_on,omitempty"`
+	PayloadOff        string          `json:"payload_off,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+type discoveryDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+}
+
+// publish retained home assistant mqtt discovery configs for a binary_sensor of each car's at home state and
+// a cover for each garage door; covers use home assistant's default OPEN and CLOSE command payloads, and
+// states match the door states reported by myq and ratgdo
+func Discovery(config t.ConfigStruct) {
+	device := discoveryDevice{Identifiers: []string{"myq_teslamate_geofence"}, Name: "MyQ TeslaMate Geofence"}
+	availabilityTopic := AvailabilityTopic(config)
+	covers := map[string]bool{}
+	for _, car := range config.Cars {
+		for _, door := range car.GarageDoors {
+			objectID := objectIDRegex.ReplaceAllString(fmt.Sprintf("car_%d_%s_at_home", car.CarID, door.MyQSerial), "_")
+			publishJSON(config, fmt.Sprintf("homeassistant/binary_sensor/myq_teslamate_geofence/%s/config", objectID), discoveryConfig{
+				Name:              fmt.Sprintf("Car %d at home (%s)", car.CarID, door.MyQSerial),
+				UniqueID:          "myq_teslamate_geofence_" + objectID,
+				DeviceClass:       "presence",
+				StateTopic:        topic(config, "cars/%d/%s/at_home", car.CarID, door.MyQSerial),
+				AvailabilityTopic: availabilityTopic,
+				PayloadOn:         "ON",
+				PayloadOff:        "OFF",
+				Device:            device,
+			})
+
+			if covers[door.MyQSerial] {
+				continue // a door shared by several cars only needs one cover
+			}
+			covers[door.MyQSerial] = true
+			objectID = objectIDRegex.ReplaceAllString("door_"+door.MyQSerial, "_")
+			publishJSON(config, fmt.Sprintf("homeassistant/cover/myq_teslamate_geofence/%s/config", objectID), discoveryConfig{
+				Name:              fmt.Sprintf("Garage door %s", door.MyQSerial),
+				UniqueID:          "myq_teslamate_geofence_" + objectID,
+				DeviceClass:       "garage",
+				StateTopic:        doorTopic(config, door.MyQSerial, "state"),
+				CommandTopic:      doorTopic(config, door.MyQSerial, "set"),
+				AvailabilityTopic: availabilityTopic,
+				Device:            device,
+			})
+		}
+	}
+}
+
+// publish v as a retained json message to the topic
+func publishJSON(config t.ConfigStruct, topic string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Could not marshal MQTT payload", "topic", topic, "error", err)
+		return
+	}
+	publish(config, topic, true, string(payload))
+}
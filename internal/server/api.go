@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"myq-teslamate-geofence/internal/garage"
+	geo "myq-teslamate-geofence/internal/geo"
+	t "myq-teslamate-geofence/internal/types"
+)
+
+type doorActionResult struct {
+	Serial string `json:"serial"`
+	State  string `json:"state,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// returns the http status for a failed door action: 409 if the door wasn't in a state to act on or is already being
+// operated, 504 if it didn't finish moving in time, and 502 for other failures of the controller
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, geo.ErrStateMismatch), errors.Is(err, geo.ErrDoorBusy):
+		return http.StatusConflict
+	case errors.Is(err, geo.ErrTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// wrap handler so that it's only called if the request has an "Authorization: Bearer <token>" header matching token
+func RequireToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// returns a handler for POST /cars/{id}/door/{open|close} that operates the car's garage doors through the same
+// path used by the geofence logic and responds with the resulting state of each door as json; an optional
+// serial query parameter limits the action to a single door
+func DoorActionHandler(getConfig func() t.ConfigStruct) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// path is /cars/{id}/door/{action}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 || parts[0] != "cars" || parts[2] != "door" {
+			http.NotFound(w, r)
+			return
+		}
+		action := parts[3]
+		if action != garage.ActionOpen && action != garage.ActionClose {
+			http.NotFound(w, r)
+			return
+		}
+		carID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		var car *t.Car
+		for _, c := range config.Cars {
+			if c.CarID == carID {
+				car = c
+			}
+		}
+		if car == nil {
+			http.Error(w, "car not found", http.StatusNotFound)
+			return
+		}
+
+		serial := r.URL.Query().Get("serial")
+		var results []doorActionResult
+		status := http.StatusOK
+		for _, door := range car.GarageDoors {
+			if serial != "" && door.MyQSerial != serial {
+				continue
+			}
+			slog.Info("Received manual door action request", "car_id", car.CarID, "door_serial", door.MyQSerial, "action", action)
+			result := doorActionResult{Serial: door.MyQSerial}
+			if result.State, err = geo.OperateGarageDoor(r.Context(), config, car, door, action); err != nil {
+				result.Error = err.Error()
+				status = errorStatus(err)
+			}
+			results = append(results, result)
+		}
+		if len(results) == 0 {
+			http.Error(w, "garage door not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(results)
+	})
+}
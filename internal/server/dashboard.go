@@ -0,0 +1,79 @@
+package server
+
+import (
+	"embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	t "myq-teslamate-geofence/internal/types"
+)
+
+//go:embed templates/dashboard.html
+var templates embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(templates, "templates/dashboard.html"))
+
+const dashboardRefreshSeconds = 5
+
+type carStatus struct {
+	CarID int
+	Lat   float64
+	Lng   float64
+	Doors []doorStatus
+}
+
+type doorStatus struct {
+	Serial         string
+	Initialized    bool
+	AtHome         bool
+	LastActionTime time.Time
+}
+
+// take a consistent snapshot of each car's runtime state
+func carStatuses(cars []*t.Car) []carStatus {
+	statuses := make([]carStatus, 0, len(cars))
+	for _, car := range cars {
+		car.Lock()
+		status := carStatus{
+			CarID: car.CarID,
+			Lat:   car.CurLat,
+			Lng:   car.CurLng,
+		}
+		for _, door := range car.GarageDoors {
+			status.Doors = append(status.Doors, doorStatus{
+				Serial:         door.MyQSerial,
+				Initialized:    door.Initialized,
+				AtHome:         door.AtHome,
+				LastActionTime: door.LastActionTime,
+			})
+		}
+		car.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// returns a read-only html dashboard of each car's position and garage door state, refreshed periodically
+func DashboardHandler(getConfig func() t.ConfigStruct) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		data := struct {
+			Cars           []carStatus
+			Updated        time.Time
+			RefreshSeconds int
+		}{
+			Cars:           carStatuses(getConfig().Cars),
+			Updated:        time.Now(),
+			RefreshSeconds: dashboardRefreshSeconds,
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, data); err != nil {
+			slog.Error("Unable to render dashboard", "error", err)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// one mux per port so that features configured with the same port share a server
+var muxes = map[int]*http.ServeMux{}
+
+// register a handler for pattern on the server listening on port
+func Handle(port int, pattern string, handler http.Handler) {
+	mux, exists := muxes[port]
+	if !exists {
+		mux = http.NewServeMux()
+		muxes[port] = mux
+	}
+	mux.Handle(pattern, handler)
+}
+
+// start an http server in the background for each port with registered handlers
+func Start() {
+	for port, mux := range muxes {
+		port, mux := port, mux
+		go func() {
+			slog.Info("Serving http", "port", port)
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
+				slog.Error("HTTP server stopped", "port", port, "error", err)
+			}
+		}()
+	}
+}
+
+// returns a handler that responds with 200 if all checks pass and 503 otherwise
+func HealthHandler(checks ...func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, check := range checks {
+			if !check() {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	geo "myq-teslamate-geofence/internal/geo"
+	t "myq-teslamate-geofence/internal/types"
+)
+
+// json body of GET /state
+type runtimeState struct {
+	Paused bool       `json:"paused"`
+	Cars   []carState `json:"cars"`
+}
+
+type carState struct {
+	CarID             int         `json:"car_id"`
+	Lat               float64     `json:"lat"`
+	Lng               float64     `json:"lng"`
+	TeslamateGeofence string      `json:"teslamate_geofence,omitempty"`
+	Doors             []doorState `json:"doors"`
+}
+
+type doorState struct {
+	Serial                   string          `json:"serial"`
+	Initialized              bool            `json:"initialized"`
+	AtHome                   bool            `json:"at_home"`
+	OpLock                   bool            `json:"op_lock"`
+	LastAction               string          `json:"last_action,omitempty"`
+	LastActionTime           *time.Time      `json:"last_action_time,omitempty"`
+	CooldownRemainingSeconds float64         `json:"cooldown_remaining_seconds"`
+	DisabledUntil            *time.Time      `json:"disabled_until,omitempty"`
+	CloseGeofence            *geofenceConfig `json:"close_geofence,omitempty"`
+	OpenGeofence             *geofenceConfig `json:"open_geofence,omitempty"`
+}
+
+type geofenceConfig struct {
+	Center       *point   `json:"center,omitempty"`
+	Location     string   `json:"location,omitempty"`
+	Radius       float64  `json:"radius,omitempty"` // meters
+	Polygon      []point  `json:"polygon,omitempty"`
+	MinElevation *float64 `json:"min_elevation,omitempty"` // meters
+	MaxElevation *float64 `json:"max_elevation,omitempty"` // meters
+
+	// set instead of the shape above if the geofence is made up of other geofences
+	Geofences []*geofenceConfig `json:"geofences,omitempty"`
+	Match     string            `json:"match,omitempty"`
+}
+
+type point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// returns a handler for GET /state that responds with the runtime state of each car and its garage doors as json,
+// along with the geofences configured for each door
+func StateHandler(getConfig func() t.ConfigStruct) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		config := getConfig()
+		state := runtimeState{Paused: geo.Paused(), Cars: []carState{}}
+		for _, car := range config.Cars {
+			car.Lock()
+			cs := carState{
+				CarID:             car.CarID,
+				Lat:               car.CurLat,
+				Lng:               car.CurLng,
+				TeslamateGeofence: car.CurGeofence,
+			}
+			for _, door := range car.GarageDoors {
+				ds := doorState{
+					Serial:                   door.MyQSerial,
+					Initialized:              door.Initialized,
+					AtHome:                   door.AtHome,
+					OpLock:                   door.OpLock,
+					LastAction:               door.LastAction,
+					LastActionTime:           timeOrNil(door.LastActionTime),
+					CooldownRemainingSeconds: geo.CooldownRemaining(config, car, door).Round(time.Millisecond).Seconds(),
+					DisabledUntil:            timeOrNil(door.DisabledUntil),
+				}
+				if car.TriggerOnGeofenceName == "" {
+					ds.CloseGeofence = newGeofenceConfig(door.GarageCloseGeo)
+					ds.OpenGeofence = newGeofenceConfig(door.GarageOpenGeo)
+				}
+				cs.Doors = append(cs.Doors, ds)
+			}
+			car.Unlock()
+			state.Cars = append(state.Cars, cs)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+}
+
+// returns the geofence as json, or nil if it isn't defined
+func newGeofenceConfig(geofence t.Geofence) *geofenceConfig {
+	if !geofence.Defined() {
+		return nil
+	}
+	g := &geofenceConfig{
+		Location:     geofence.Location,
+		MinElevation: (*float64)(geofence.MinElevation),
+		MaxElevation: (*float64)(geofence.MaxElevation),
+	}
+	if len(geofence.Geofences) > 0 {
+		for _, sub := range geofence.Geofences {
+			g.Geofences = append(g.Geofences, newGeofenceConfig(sub))
+		}
+		g.Match = geofence.MatchMode()
+		return g
+	}
+	if len(geofence.Polygon) > 0 {
+		for _, p := range geofence.Polygon {
+			g.Polygon = append(g.Polygon, point{Lat: p.Lat, Lng: p.Lng})
+		}
+		return g
+	}
+	g.Center = &point{Lat: geofence.Center.Lat, Lng: geofence.Center.Lng}
+	g.Radius = float64(geofence.Radius)
+	return g
+}
+
+// returns nil for the zero time so that it's omitted from json
+func timeOrNil(tm time.Time) *time.Time {
+	if tm.IsZero() {
+		return nil
+	}
+	return &tm
+}
@@ -1,37 +1,919 @@
 package types
 
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
 type (
+	// Distance in meters; unmarshals from a number with an optional unit (m, km, mi, or ft), e.g. "35m" or "0.1 mi"
+	Distance float64
+
+	// Duration unmarshals from a go duration string, e.g. "90s" or "2m", or a number of seconds
+	Duration time.Duration
+
+	// MinuteDuration unmarshals from a go duration string, e.g. "90s" or "2m", or a number of minutes, which is
+	// how cooldowns were configured before duration strings were supported
+	MinuteDuration time.Duration
+
+	// Point unmarshals from lat and lng fields, or a single "lat, lng" string as copied from a map; each coordinate
+	// can be decimal degrees, degrees with minutes and seconds (e.g. 48°51'29.5"N), and have an N, S, E, or W
+	// hemisphere instead of a sign
 	Point struct {
 		Lat float64 `yaml:"lat"`
 		Lng float64 `yaml:"lng"`
 	}
 
 	Geofence struct {
-		Center Point   `yaml:"geo_center"`
-		Radius float64 `yaml:"geo_radius"`
+		Center   Point    `yaml:"geo_center"`
+		Location string   `yaml:"location"` // name of an entry in global.locations to use as the center instead of geo_center
+		Radius   Distance `yaml:"geo_radius"`
+		Polygon  []Point  `yaml:"geo_polygon"` // if defined, takes precedence over center and radius
+
+		// optional elevation band the car must also be within to be inside the geofence, e.g. to ignore a road
+		// passing over or under it; ignored while teslamate hasn't reported the car's elevation
+		MinElevation *Distance `yaml:"min_elevation"`
+		MaxElevation *Distance `yaml:"max_elevation"`
+
+		// if defined, the geofence is made up of these geofences instead of its own center, radius, or polygon,
+		// and the car is inside it when it's inside any (the default) or all of them, per match
+		Geofences []Geofence `yaml:"geofences"`
+		Match     string     `yaml:"match"`
+	}
+
+	GarageDoor struct {
+		MyQSerial      string   `yaml:"myq_serial"`
+		GarageCloseGeo Geofence `yaml:"garage_close_geofence"`
+		GarageOpenGeo  Geofence `yaml:"garage_open_geofence"`
+
+		// wait for the door to report that it finished opening or closing after each action; defaults to true
+		ConfirmStateChange *bool `yaml:"confirm_state_change"`
+
+		*DoorState `yaml:"-"`
+	}
+
+	// runtime state of a garage door, guarded by the owning car's mutex; kept separate from
+	// the door's config so it can be carried over when the config is reloaded
+	DoorState struct {
+		OpLock          bool
+		Initialized     bool // AtHome has been set from the car's first position
+		AtHome          bool
+		LastActionTime  time.Time // time of the last garage door action, used to enforce the cooldown
+		LastAction      string    // last garage door action, which determines the cooldown
+		Confirmations   int       // consecutive updates that have agreed on the pending action
+		PendingSince    time.Time // time of the first of the consecutive updates that have agreed on the pending action
+		Failures        int       // consecutive failed garage door actions, counted by the circuit breaker
+		DisabledUntil   time.Time // if in the future, the circuit breaker has disabled the door after repeated failures
+		CooldownSkipped string    // action the car's position called for during the current cooldown, so it's only reported once
+		Scheduled       string    // action waiting out the car's open_delay or close_delay
+		ScheduledTimer  *time.Timer
 	}
 
 	Car struct {
-		CarID          int      `yaml:"teslamate_car_id"`
+		CarID                       int             `yaml:"teslamate_car_id"`
+		Enabled                     *bool           `yaml:"enabled"` // if false, the car's positions are ignored so it doesn't operate any doors; defaults to true
+		GarageDoors                 []*GarageDoor   `yaml:"garage_doors"`
+		Controller                  string          `yaml:"controller"` // myq or ratgdo; defaults to myq
+		MyQEmail                    string          `yaml:"myq_email"`  // myq account for this car's garage doors; defaults to the global account
+		MyQPass                     string          `yaml:"myq_pass"`
+		TriggerOnGeofenceName       string          `yaml:"trigger_on_geofence_name"`        // if set, open and close when entering and leaving this TeslaMate geofence instead of using coordinates
+		GeofenceBuffer              Distance        `yaml:"geofence_buffer"`                 // hysteresis band around geo_radius; must be beyond radius + buffer to close and within radius - buffer to open
+		RequiredConfirmations       int             `yaml:"required_confirmations"`          // consecutive updates that must agree the car crossed a geofence before acting; defaults to 1
+		SmoothingWindow             int             `yaml:"smoothing_window"`                // number of recent positions to average before checking geofences, to smooth out gps jitter; defaults to 1
+		DwellTime                   *Duration       `yaml:"dwell_time"`                      // how long the car must stay across a geofence before acting; defaults to the global dwell_time
+		Mode                        string          `yaml:"mode"`                            // open-close, open-only, or close-only; defaults to open-close
+		ActiveHours                 ActiveHours     `yaml:"active_hours"`                    // if defined, only operate the garage doors during these hours
+		OpenCooldown                *MinuteDuration `yaml:"open_cooldown"`                   // how long to wait after opening before checking geofences again; defaults to the global cooldown
+		CloseCooldown               *MinuteDuration `yaml:"close_cooldown"`                  // how long to wait after closing before checking geofences again; defaults to the global cooldown
+		OpenDelay                   Duration        `yaml:"open_delay"`                      // how long to wait after deciding to open before opening, cancelled if the car turns back
+		CloseDelay                  Duration        `yaml:"close_delay"`                     // how long to wait after deciding to close before closing, cancelled if the car turns back
+		MinTriggerSpeed             float64         `yaml:"min_trigger_speed"`               // if set, only check geofences while the car's speed reported by teslamate is at least this many km/h
+		SuppressCloseWhilePluggedIn bool            `yaml:"suppress_close_while_plugged_in"` // don't close while teslamate reports the car plugged in, since it can't be leaving
+		InvertActions               bool            `yaml:"invert_actions"`                  // open the garage doors when the car leaves and close them when it arrives, e.g. for an exit gate
+
+		// single garage door settings from before garage_doors was supported; if set, these are
+		// converted to an entry in GarageDoors when the config is loaded
 		MyQSerial      string   `yaml:"myq_serial"`
 		GarageCloseGeo Geofence `yaml:"garage_close_geofence"`
 		GarageOpenGeo  Geofence `yaml:"garage_open_geofence"`
+
+		*CarState `yaml:"-"`
+	}
+
+	// a latitude or longitude waiting to be paired with the other coordinate of its position
+	PendingCoordinate struct {
+		Value    float64
+		Received time.Time
+	}
+
+	// copy of the position a car's geofences are checked against, taken when the check is queued so that it
+	// evaluates the position that triggered it rather than whatever the car has received since
+	Position struct {
+		Point        Point
+		LatTime      time.Time // time the latitude was received
+		LngTime      time.Time // time the longitude was received
+		Elevation    *float64  // meters, or nil if teslamate hasn't reported one
+		Geofence     string    // name of the TeslaMate geofence the car is in
+		GeofenceTime time.Time // time the teslamate geofence was received
+	}
+
+	// runtime state of a car; kept separate from the car's config so it can be carried over
+	// when the config is reloaded
+	CarState struct {
+		sync.Mutex            // guards the fields below and the state of the car's garage doors
+		CurGeofence    string // name of the TeslaMate geofence the car is currently in
 		CurLat         float64
 		CurLng         float64
-		OpLock         bool
-		AtHome         bool
+		PairRetained   bool      // a coordinate of the pending lat/lng pair was a retained message replayed on (re)connecting
+		LatTime        time.Time // time the latitude was last received, for max_position_age
+		LngTime        time.Time // time the longitude was last received
+		GeofenceTime   time.Time // time the teslamate geofence was last received
+		RecentPoints   []Point   // the car's last smoothing_window positions, oldest first
+		CurSpeed       float64   // km/h, as reported by teslamate
+		SpeedKnown     bool      // a speed has been received from teslamate
+		CurElevation   float64   // meters, as reported by teslamate
+		ElevationKnown bool      // an elevation has been received from teslamate
+		PluggedIn      bool      // teslamate reports the car's charge cable plugged in
+
+		// coordinates waiting to be paired into a position, oldest first, and when the pair window timer was
+		// started for the oldest of them
+		PendingLats   []PendingCoordinate
+		PendingLngs   []PendingCoordinate
+		PairStartTime time.Time
+	}
+
+	// daily window of local time during which garage door actions are allowed; if end is before start,
+	// the window crosses midnight
+	ActiveHours struct {
+		Start    string   `yaml:"start"`    // 24h time, e.g. 07:00
+		End      string   `yaml:"end"`      // 24h time, e.g. 21:00
+		Timezone string   `yaml:"timezone"` // IANA time zone, e.g. America/New_York; defaults to the system time zone
+		Actions  []string `yaml:"actions"`  // actions limited to the window, open and/or close; defaults to both
+	}
+
+	// mqtt topics used to control garage doors running ratgdo firmware, where %s is the door's serial
+	Ratgdo struct {
+		CommandTopic string `yaml:"command_topic"` // defaults to ratgdo/%s/command/door
+		StatusTopic  string `yaml:"status_topic"`  // defaults to ratgdo/%s/status/door
+	}
+
+	// topics under mqtt_topic_prefix/<teslamate_car_id>/ that each of a car's values are read from; each defaults
+	// to teslamate's topic of the same name
+	Topics struct {
+		Geofence        string `yaml:"geofence"`
+		Latitude        string `yaml:"latitude"`
+		Longitude       string `yaml:"longitude"`
+		Speed           string `yaml:"speed"`
+		Elevation       string `yaml:"elevation"`
+		PluggedIn       string `yaml:"plugged_in"`
+		Location        string `yaml:"location"`          // json message with both coordinates, read instead of latitude and longitude; disabled if unset
+		LocationLatPath string `yaml:"location_lat_path"` // dot separated path to the latitude in the location message; defaults to latitude
+		LocationLngPath string `yaml:"location_lng_path"` // dot separated path to the longitude in the location message; defaults to longitude
+	}
+
+	Notifications struct {
+		Provider string `yaml:"provider"` // ntfy or gotify; notifications are disabled if unset
+		URL      string `yaml:"url"`      // ntfy topic url or gotify server url
+		Token    string `yaml:"token"`    // ntfy access token or gotify application token
+	}
+
+	// url that geofence crossing events are posted to as json
+	Webhook struct {
+		URL string `yaml:"url"`
 	}
 
 	ConfigStruct struct {
 		Global struct {
-			MqttHost     string `yaml:"mqtt_host"`
-			MqttPort     int    `yaml:"mqtt_port"`
-			MqttClientID string `yaml:"mqtt_client_id"`
-			OpCooldown   int    `yaml:"cooldown"`
-			MyQEmail     string `yaml:"myq_email"`
-			MyQPass      string `yaml:"myq_pass"`
+			MqttHost                 string           `yaml:"mqtt_host"`
+			MqttPort                 int              `yaml:"mqtt_port"`
+			MqttBrokers              []string         `yaml:"mqtt_brokers"` // host:port of each broker to try in order, used instead of mqtt_host and mqtt_port if set
+			MqttClientID             string           `yaml:"mqtt_client_id"`
+			MqttAutoReconnect        *bool            `yaml:"mqtt_auto_reconnect"`         // defaults to true
+			MqttConnectRetryInterval Duration         `yaml:"mqtt_connect_retry_interval"` // how long to wait between attempts when initially connecting
+			MqttMaxReconnectInterval Duration         `yaml:"mqtt_max_reconnect_interval"` // longest to back off between reconnect attempts
+			MqttUsername             string           `yaml:"mqtt_user"`
+			MqttPassword             string           `yaml:"mqtt_pass"`
+			MqttUseTLS               bool             `yaml:"mqtt_use_tls"`
+			MqttTLSCACert            string           `yaml:"mqtt_tls_ca_cert"`         // path to a CA cert used to verify the broker; system roots are used if unset
+			MqttTLSClientCert        string           `yaml:"mqtt_tls_client_cert"`     // path to a client cert presented to the broker for mutual tls; requires mqtt_tls_client_key
+			MqttTLSClientKey         string           `yaml:"mqtt_tls_client_key"`      // path to the client cert's private key
+			MqttTLSInsecure          bool             `yaml:"mqtt_tls_insecure"`        // don't verify the broker's cert, e.g. a self-signed cert without a CA; insecure
+			MqttUseWebsocket         bool             `yaml:"mqtt_use_websocket"`       // connect to the broker over websockets (ws:// or wss://), e.g. through an http proxy
+			MqttWebsocketPath        string           `yaml:"mqtt_websocket_path"`      // path of the broker's websocket endpoint, e.g. /mqtt
+			MqttQoS                  int              `yaml:"mqtt_qos"`                 // qos (0, 1, or 2) for teslamate subscriptions and publishes; defaults to 0
+			MqttProtocolVersion      int              `yaml:"mqtt_protocol_version"`    // 3 for mqtt 3.1 or 4 for 3.1.1; if unset, 3.1.1 is tried first, falling back to 3.1
+			MqttTopicPrefix          string           `yaml:"mqtt_topic_prefix"`        // prefix of teslamate's car topics; defaults to teslamate/cars
+			MqttPublishPrefix        string           `yaml:"mqtt_publish_prefix"`      // prefix of the topics this app publishes to; defaults to myq-geofence
+			AvailabilityTopic        string           `yaml:"availability_topic"`       // topic to publish online/offline to; defaults to <prefix>/availability
+			ControlTopic             string           `yaml:"control_topic"`            // topic to pause (false) and resume (true) all geofence automation; defaults to <prefix>/control/enabled
+			HomeAssistantDiscovery   bool             `yaml:"home_assistant_discovery"` // publish home assistant mqtt discovery configs for each car and door
+			PublishDistance          bool             `yaml:"publish_distance"`         // publish each car's distance from its geofences to <prefix>/cars/<id>/<serial>/distance
+			LogLevel                 string           `yaml:"log_level"`                // debug, info, warn, or error; defaults to info
+			LogFormat                string           `yaml:"log_format"`               // text or json; defaults to text
+			HealthPort               int              `yaml:"health_port"`              // port to serve /healthz and /readyz on; disabled if unset
+			WebUIPort                int              `yaml:"web_ui_port"`              // port to serve the read-only web dashboard on; disabled if unset
+			APIPort                  int              `yaml:"api_port"`                 // port to serve the manual door control api on; disabled if unset
+			APIToken                 string           `yaml:"api_token"`                // bearer token required to use the api
+			MetricsPort              int              `yaml:"metrics_port"`             // port to serve prometheus metrics on; disabled if unset
+			DistanceModel            string           `yaml:"distance_model"`           // haversine or vincenty; defaults to haversine
+			StateFile                string           `yaml:"state_file"`               // json file to persist each door's at home and cooldown state to across restarts; disabled if unset
+			Locations                map[string]Point `yaml:"locations"`                // named points, e.g. home, that geofences can use as their center with location
+			DwellTime                Duration         `yaml:"dwell_time"`               // how long a car must stay across a geofence before acting; disabled if unset
+			MaxPositionAge           Duration         `yaml:"max_position_age"`         // don't operate doors based on a position received longer ago than this; disabled if unset
+			StartupGracePeriod       *Duration        `yaml:"startup_grace_period"`     // how long after starting to evaluate geofences without operating doors; defaults to 10s
+			OpCooldown               MinuteDuration   `yaml:"cooldown"`
+			MyQEmail                 string           `yaml:"myq_email"`
+			MyQPass                  string           `yaml:"myq_pass"`
+			MyQRetryCount            int              `yaml:"myq_retry_count"`           // number of times to retry a failed MyQ call
+			MyQRetryBackoff          Duration         `yaml:"myq_retry_backoff"`         // how long to wait before the first retry, doubled for each subsequent retry
+			MyQRateLimit             int              `yaml:"myq_rate_limit"`            // max MyQ calls per minute across all accounts; defaults to 60
+			DoorActionTimeout        Duration         `yaml:"door_action_timeout"`       // how long to wait for a door to open or close; defaults to 60s
+			DoorPollInterval         Duration         `yaml:"door_poll_interval"`        // how often to check a door's state while waiting; defaults to 5s
+			BreakerThreshold         int              `yaml:"circuit_breaker_threshold"` // consecutive failed actions before a door is disabled; defaults to 3
+			BreakerCooldown          MinuteDuration   `yaml:"circuit_breaker_cooldown"`  // how long a door stays disabled before an action is retried; defaults to 15m
 		} `yaml:"global"`
-		Cars    []*Car `yaml:"cars"`
-		Testing bool
+		Cars          []*Car        `yaml:"cars"`
+		Notifications Notifications `yaml:"notifications"`
+		Webhooks      []Webhook     `yaml:"webhooks"`
+		Ratgdo        Ratgdo        `yaml:"ratgdo"`
+		Topics        Topics        `yaml:"topics"`
+		Testing       bool
+		Debug         bool
+		DryRun        bool
 	}
 )
+
+// defaults for door_action_timeout and door_poll_interval
+const (
+	DefaultDoorActionTimeout = 60 * time.Second
+	DefaultDoorPollInterval  = 5 * time.Second
+)
+
+// default for myq_rate_limit, in calls per minute
+const DefaultMyQRateLimit = 60
+
+// defaults for circuit_breaker_threshold (failures) and circuit_breaker_cooldown
+const (
+	DefaultBreakerThreshold = 3
+	DefaultBreakerCooldown  = 15 * time.Minute
+)
+
+// default for startup_grace_period
+const DefaultStartupGracePeriod = 10 * time.Second
+
+// values for a geofence's match, which combines the geofences it's made up of
+const (
+	GeofenceMatchAny = "any"
+	GeofenceMatchAll = "all"
+)
+
+// models for measuring the distance between points
+const (
+	DistanceModelHaversine = "haversine"
+	DistanceModelVincenty  = "vincenty"
+)
+
+// car modes, limiting which actions the geofences trigger
+const (
+	ModeOpenClose = "open-close"
+	ModeOpenOnly  = "open-only"
+	ModeCloseOnly = "close-only"
+)
+
+// meters per unit supported by Distance
+var distanceUnits = map[string]float64{
+	"":   1, // meters when no unit is given
+	"m":  1,
+	"km": 1000,
+	"mi": 1609.344,
+	"ft": 0.3048,
+}
+
+var distanceRegex = regexp.MustCompile(`^\s*([-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)\s*([a-zA-Z]*)\s*$`)
+
+func (d *Distance) UnmarshalYAML(value *yaml.Node) error {
+	match := distanceRegex.FindStringSubmatch(value.Value)
+	if match == nil {
+		return fmt.Errorf("line %d: invalid distance %q, expected a number with an optional unit (m, km, mi, ft)", value.Line, value.Value)
+	}
+	multiplier, ok := distanceUnits[strings.ToLower(match[2])]
+	if !ok {
+		return fmt.Errorf("line %d: invalid distance unit %q, expected one of m, km, mi, ft", value.Line, match[2])
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid distance %q: %v", value.Line, value.Value, err)
+	}
+	*d = Distance(number * multiplier)
+	return nil
+}
+
+// matches a coordinate in decimal degrees or degrees, minutes, and seconds, with an optional sign or hemisphere
+var coordinateRegex = regexp.MustCompile(`^([NSEW])?\s*(-)?(\d+(?:\.\d+)?)\s*[°º]?\s*(?:(\d+(?:\.\d+)?)\s*['′’]?\s*)?(?:(\d+(?:\.\d+)?)\s*(?:"|″|”|'')?\s*)?([NSEW])?$`)
+
+func (p *Point) UnmarshalYAML(value *yaml.Node) error {
+	var lat, lng string
+	latLine, lngLine := value.Line, value.Line
+	if value.Kind == yaml.ScalarNode {
+		var ok bool
+		if lat, lng, ok = splitPoint(value.Value); !ok {
+			return fmt.Errorf("line %d: invalid point %q, expected lat and lng fields or a \"lat, lng\" string", value.Line, value.Value)
+		}
+	} else {
+		var fields struct {
+			Lat yaml.Node `yaml:"lat"`
+			Lng yaml.Node `yaml:"lng"`
+		}
+		if err := value.Decode(&fields); err != nil {
+			return err
+		}
+		lat, lng = fields.Lat.Value, fields.Lng.Value
+		latLine, lngLine = max(fields.Lat.Line, value.Line), max(fields.Lng.Line, value.Line)
+	}
+	var err error
+	if p.Lat, err = parseCoordinate(lat, "N", "S"); err != nil {
+		return fmt.Errorf("line %d: invalid lat %q: %v", latLine, lat, err)
+	}
+	if p.Lng, err = parseCoordinate(lng, "E", "W"); err != nil {
+		return fmt.Errorf("line %d: invalid lng %q: %v", lngLine, lng, err)
+	}
+	return nil
+}
+
+// split a "lat, lng" string into its coordinates, also accepting the two separated by a hemisphere or whitespace
+// alone, e.g. 48°51'29.5"N 2°17'40.9"E
+func splitPoint(point string) (lat string, lng string, ok bool) {
+	point = strings.TrimSpace(point)
+	if before, after, found := strings.Cut(point, ","); found {
+		return before, after, true
+	}
+	upper := strings.ToUpper(point)
+	if i := strings.IndexAny(upper, "NS"); i > 0 && strings.TrimSpace(point[i+1:]) != "" {
+		return point[:i+1], point[i+1:], true // hemisphere after the latitude
+	}
+	if i := strings.IndexAny(upper, "EW"); i > 0 && strings.IndexAny(upper[:1], "NS") == 0 {
+		return point[:i], point[i:], true // hemisphere before each coordinate
+	}
+	if fields := strings.Fields(point); len(fields) == 2 {
+		return fields[0], fields[1], true
+	}
+	return "", "", false
+}
+
+// parse a coordinate in decimal degrees or degrees, minutes, and seconds, where positive and negative may be
+// given by the positive or negative hemisphere letter instead of a sign
+func parseCoordinate(coordinate string, positive string, negative string) (float64, error) {
+	match := coordinateRegex.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(coordinate)))
+	if match == nil {
+		return 0, fmt.Errorf("expected decimal degrees (e.g. 48.858195) or degrees, minutes, and seconds (e.g. 48°51'29.5\"%s)", positive)
+	}
+	prefix, sign, hemisphere := match[1], match[2], match[6]
+	if prefix != "" && hemisphere != "" {
+		return 0, fmt.Errorf("hemisphere is given twice")
+	}
+	hemisphere += prefix
+	if hemisphere != "" && hemisphere != positive && hemisphere != negative {
+		return 0, fmt.Errorf("hemisphere must be %s or %s, found %s", positive, negative, hemisphere)
+	}
+	if hemisphere != "" && sign != "" {
+		return 0, fmt.Errorf("use either a sign or a hemisphere, not both")
+	}
+
+	var parts [3]float64
+	for i, part := range match[3:6] {
+		if part == "" {
+			continue
+		}
+		parts[i], _ = strconv.ParseFloat(part, 64) // matched as a number by the regex
+		if i > 0 && (parts[i] >= 60 || strings.Contains(match[i+2], ".")) {
+			return 0, fmt.Errorf("minutes and seconds must be below 60, and only the last part can have decimals")
+		}
+	}
+	degrees := parts[0] + parts[1]/60 + parts[2]/3600
+	if sign != "" || hemisphere == negative {
+		degrees = -degrees
+	}
+	return degrees, nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	duration, err := unmarshalDuration(value, time.Second)
+	*d = Duration(duration)
+	return err
+}
+
+func (d *MinuteDuration) UnmarshalYAML(value *yaml.Node) error {
+	duration, err := unmarshalDuration(value, time.Minute)
+	*d = MinuteDuration(duration)
+	return err
+}
+
+// parse a go duration string, or a number in the given unit
+func unmarshalDuration(value *yaml.Node, unit time.Duration) (time.Duration, error) {
+	if number, err := strconv.ParseFloat(value.Value, 64); err == nil {
+		return time.Duration(number * float64(unit)), nil
+	}
+	duration, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return 0, fmt.Errorf("line %d: invalid duration %q, expected e.g. 90s or 5m, or a number of %s", value.Line, value.Value,
+			map[time.Duration]string{time.Second: "seconds", time.Minute: "minutes"}[unit])
+	}
+	return duration, nil
+}
+
+// returns true unless mqtt_auto_reconnect has been disabled
+func (c ConfigStruct) MqttAutoReconnects() bool {
+	return c.Global.MqttAutoReconnect == nil || *c.Global.MqttAutoReconnect
+}
+
+// Validate checks the loaded config for problems that would cause misbehavior at runtime,
+// returning an error that lists all of them rather than just the first
+func (c *ConfigStruct) Validate() error {
+	var problems []string
+	addProblem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if len(c.Global.MqttBrokers) > 0 {
+		for _, broker := range c.Global.MqttBrokers {
+			host, port, err := net.SplitHostPort(broker)
+			if number, _ := strconv.Atoi(port); err != nil || host == "" || number <= 0 || number > 65535 {
+				addProblem("global.mqtt_brokers entries must be host:port with a port between 1 and 65535, found %q", broker)
+			}
+		}
+	} else {
+		if c.Global.MqttHost == "" {
+			addProblem("global.mqtt_host or global.mqtt_brokers must be set")
+		}
+		if c.Global.MqttPort <= 0 || c.Global.MqttPort > 65535 {
+			addProblem("global.mqtt_port must be between 1 and 65535, found %d", c.Global.MqttPort)
+		}
+	}
+	if c.Global.MqttClientID == "" {
+		addProblem("global.mqtt_client_id must be set")
+	}
+	if c.Global.MqttQoS < 0 || c.Global.MqttQoS > 2 {
+		addProblem("global.mqtt_qos must be 0, 1, or 2, found %d", c.Global.MqttQoS)
+	}
+	switch c.Global.MqttProtocolVersion {
+	case 0, 3, 4:
+	case 5:
+		addProblem("global.mqtt_protocol_version 5 isn't supported yet, use 3 (mqtt 3.1) or 4 (mqtt 3.1.1)")
+	default:
+		addProblem("global.mqtt_protocol_version must be 3 (mqtt 3.1) or 4 (mqtt 3.1.1), found %d", c.Global.MqttProtocolVersion)
+	}
+	if (c.Global.MqttTLSClientCert == "") != (c.Global.MqttTLSClientKey == "") {
+		addProblem("global.mqtt_tls_client_cert and global.mqtt_tls_client_key must be set together")
+	}
+	if strings.ContainsAny(c.Global.MqttTopicPrefix, "+#") {
+		addProblem("global.mqtt_topic_prefix must not contain mqtt wildcards (+ or #), found %q", c.Global.MqttTopicPrefix)
+	}
+	if strings.ContainsAny(c.Global.MqttPublishPrefix, "+#") {
+		addProblem("global.mqtt_publish_prefix must not contain mqtt wildcards (+ or #), found %q", c.Global.MqttPublishPrefix)
+	}
+	if strings.ContainsAny(c.Global.ControlTopic, "+#") {
+		addProblem("global.control_topic must not contain mqtt wildcards (+ or #), found %q", c.Global.ControlTopic)
+	}
+	if strings.ContainsAny(c.Global.AvailabilityTopic, "+#") {
+		addProblem("global.availability_topic must not contain mqtt wildcards (+ or #), found %q", c.Global.AvailabilityTopic)
+	}
+	if c.Global.DoorActionTimeout < 0 || c.Global.DoorPollInterval < 0 {
+		addProblem("global.door_action_timeout and global.door_poll_interval must be positive")
+	} else if timeout, interval := orDefault(time.Duration(c.Global.DoorActionTimeout), DefaultDoorActionTimeout), orDefault(time.Duration(c.Global.DoorPollInterval), DefaultDoorPollInterval); interval >= timeout {
+		addProblem("global.door_poll_interval (%v) must be less than global.door_action_timeout (%v)", interval, timeout)
+	}
+	for name, point := range c.Global.Locations {
+		if !point.valid() {
+			addProblem("global.locations %s %v is out of range (lat must be within ±90, lng within ±180); are lat and lng swapped?", name, point)
+		}
+	}
+	if c.Global.MyQRateLimit < 0 {
+		addProblem("global.myq_rate_limit must be positive, found %d", c.Global.MyQRateLimit)
+	}
+	if c.Global.DwellTime < 0 {
+		addProblem("global.dwell_time must be positive")
+	}
+	if c.Global.MaxPositionAge < 0 {
+		addProblem("global.max_position_age must be positive")
+	}
+	if c.Global.StartupGracePeriod != nil && *c.Global.StartupGracePeriod < 0 {
+		addProblem("global.startup_grace_period must be positive")
+	}
+	if c.Global.OpCooldown < 0 {
+		addProblem("global.cooldown must be positive, found %v", time.Duration(c.Global.OpCooldown))
+	}
+	if c.Global.BreakerThreshold < 0 || c.Global.BreakerCooldown < 0 {
+		addProblem("global.circuit_breaker_threshold and global.circuit_breaker_cooldown must be positive")
+	}
+	switch c.Global.DistanceModel {
+	case "", DistanceModelHaversine, DistanceModelVincenty:
+	default:
+		addProblem("global.distance_model must be one of %s or %s, found %q", DistanceModelHaversine, DistanceModelVincenty, c.Global.DistanceModel)
+	}
+	if c.Global.APIPort > 0 && c.Global.APIToken == "" {
+		addProblem("global.api_token must be set when global.api_port is set")
+	}
+	if len(c.Cars) == 0 {
+		addProblem("at least one car must be defined")
+	}
+
+	switch c.Notifications.Provider {
+	case "":
+	case "ntfy", "gotify":
+		if c.Notifications.URL == "" {
+			addProblem("notifications.url must be set when notifications.provider is set")
+		}
+		if c.Notifications.Provider == "gotify" && c.Notifications.Token == "" {
+			addProblem("notifications.token must be set for gotify")
+		}
+	default:
+		addProblem("notifications.provider must be one of ntfy or gotify, found %q", c.Notifications.Provider)
+	}
+
+	for i, webhook := range c.Webhooks {
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addProblem("webhook %d: url must be an http or https url, found %q", i+1, webhook.URL)
+		}
+	}
+
+	if c.Ratgdo.CommandTopic != "" && strings.Count(c.Ratgdo.CommandTopic, "%s") != 1 {
+		addProblem("ratgdo.command_topic must contain %%s once, where the door's serial goes, found %q", c.Ratgdo.CommandTopic)
+	}
+	if c.Ratgdo.StatusTopic != "" && strings.Count(c.Ratgdo.StatusTopic, "%s") != 1 {
+		addProblem("ratgdo.status_topic must contain %%s once, where the door's serial goes, found %q", c.Ratgdo.StatusTopic)
+	}
+	for _, problem := range c.Topics.validate() {
+		addProblem("topics.%s", problem)
+	}
+
+	carIDs := map[int]bool{}
+	for i, car := range c.Cars {
+		if car.CarID <= 0 {
+			addProblem("car %d: teslamate_car_id must be set", i+1)
+		} else if carIDs[car.CarID] {
+			addProblem("car %d: teslamate_car_id %d is defined more than once", i+1, car.CarID)
+		}
+		carIDs[car.CarID] = true
+
+		switch car.Controller {
+		case "", "myq", "ratgdo":
+		default:
+			addProblem("car %d: controller must be one of myq or ratgdo, found %q", car.CarID, car.Controller)
+		}
+		if (car.MyQEmail == "") != (car.MyQPass == "") {
+			addProblem("car %d: myq_email and myq_pass must be set together", car.CarID)
+		}
+		switch car.Mode {
+		case "", ModeOpenClose, ModeOpenOnly, ModeCloseOnly:
+		default:
+			addProblem("car %d: mode must be one of %s, %s, or %s, found %q", car.CarID, ModeOpenClose, ModeOpenOnly, ModeCloseOnly, car.Mode)
+		}
+		if (car.OpenCooldown != nil && *car.OpenCooldown < 0) || (car.CloseCooldown != nil && *car.CloseCooldown < 0) {
+			addProblem("car %d: open_cooldown and close_cooldown must be positive", car.CarID)
+		}
+		if car.OpenDelay < 0 || car.CloseDelay < 0 {
+			addProblem("car %d: open_delay and close_delay must be positive", car.CarID)
+		}
+		if car.MinTriggerSpeed < 0 {
+			addProblem("car %d: min_trigger_speed must be positive, found %v", car.CarID, car.MinTriggerSpeed)
+		}
+		if car.GeofenceBuffer < 0 {
+			addProblem("car %d: geofence_buffer must be positive, found %vm", car.CarID, float64(car.GeofenceBuffer))
+		}
+		if car.DwellTime != nil && *car.DwellTime < 0 {
+			addProblem("car %d: dwell_time must be positive", car.CarID)
+		}
+		if car.SmoothingWindow < 0 {
+			addProblem("car %d: smoothing_window must be positive, found %d", car.CarID, car.SmoothingWindow)
+		}
+		if car.RequiredConfirmations < 0 {
+			addProblem("car %d: required_confirmations must be positive, found %d", car.CarID, car.RequiredConfirmations)
+		}
+		for _, problem := range car.ActiveHours.validate() {
+			addProblem("car %d: active_hours %s", car.CarID, problem)
+		}
+		if len(car.GarageDoors) == 0 {
+			addProblem("car %d: at least one garage door must be defined", car.CarID)
+		}
+		for j, door := range car.GarageDoors {
+			prefix := fmt.Sprintf("car %d, garage door %d", car.CarID, j+1)
+			if door.MyQSerial == "" {
+				addProblem("%s: myq_serial must be set", prefix)
+			}
+			if car.TriggerOnGeofenceName != "" {
+				continue // geofences aren't used when triggering on teslamate geofence names
+			}
+			if !door.GarageCloseGeo.Defined() && !door.GarageOpenGeo.Defined() {
+				addProblem("%s: at least one of garage_close_geofence or garage_open_geofence must be defined", prefix)
+			}
+			for _, problem := range door.GarageCloseGeo.validate() {
+				addProblem("%s: garage_close_geofence %s", prefix, problem)
+			}
+			for _, problem := range door.GarageOpenGeo.validate() {
+				addProblem("%s: garage_open_geofence %s", prefix, problem)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s) with config:\n  - %s", len(problems), strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// set the center of each geofence that references a named location to that location's point; returns an error
+// listing every geofence that references an unknown location or also sets geo_center or geo_polygon
+func (c *ConfigStruct) ResolveLocations() error {
+	var problems []string
+	for _, car := range c.Cars {
+		for j, door := range car.GarageDoors {
+			prefix := fmt.Sprintf("car %d, garage door %d: ", car.CarID, j+1)
+			problems = append(problems, c.resolveLocation(prefix+"garage_close_geofence", &door.GarageCloseGeo)...)
+			problems = append(problems, c.resolveLocation(prefix+"garage_open_geofence", &door.GarageOpenGeo)...)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s) with config:\n  - %s", len(problems), strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// set the center of the geofence, and of each geofence it's made up of, to its named location if it references
+// one; returns the problems found, prefixed with name
+func (c *ConfigStruct) resolveLocation(name string, g *Geofence) []string {
+	var problems []string
+	for i := range g.Geofences {
+		problems = append(problems, c.resolveLocation(fmt.Sprintf("%s geofences %d", name, i+1), &g.Geofences[i])...)
+	}
+	if g.Location == "" {
+		return problems
+	}
+	point, ok := c.location(g.Location)
+	switch {
+	case !ok:
+		problems = append(problems, fmt.Sprintf("%s location %q isn't defined in global.locations", name, g.Location))
+	case (g.Center != Point{} && g.Center != point) || len(g.Polygon) > 0:
+		problems = append(problems, fmt.Sprintf("%s must set only one of location, geo_center, or geo_polygon", name))
+	default:
+		g.Center = point
+	}
+	return problems
+}
+
+// returns the point of the named location, ignoring case so that e.g. home matches Home
+func (c *ConfigStruct) location(name string) (Point, bool) {
+	if point, ok := c.Global.Locations[name]; ok {
+		return point, true
+	}
+	for locationName, point := range c.Global.Locations {
+		if strings.EqualFold(locationName, name) {
+			return point, true
+		}
+	}
+	return Point{}, false
+}
+
+// returns a copy of the car's current position; caller must hold the car's lock
+func (s *CarState) Position() Position {
+	position := Position{Point: Point{Lat: s.CurLat, Lng: s.CurLng}, LatTime: s.LatTime, LngTime: s.LngTime,
+		Geofence: s.CurGeofence, GeofenceTime: s.GeofenceTime}
+	if s.ElevationKnown {
+		elevation := s.CurElevation
+		position.Elevation = &elevation
+	}
+	return position
+}
+
+// returns true unless the car has been disabled
+func (c Car) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// returns true unless confirm_state_change has been disabled for the door
+func (d GarageDoor) ConfirmsStateChange() bool {
+	return d.ConfirmStateChange == nil || *d.ConfirmStateChange
+}
+
+// returns true if a radius, polygon, or geofences have been configured for the geofence
+func (g Geofence) Defined() bool {
+	return g.Radius != 0 || len(g.Polygon) > 0 || len(g.Geofences) > 0
+}
+
+// returns how the geofences a geofence is made up of are combined, any or all; defaults to any
+func (g Geofence) MatchMode() string {
+	return orDefault(g.Match, GeofenceMatchAny)
+}
+
+// returns the problems with a geofence's configuration, if any
+func (g Geofence) validate() []string {
+	var problems []string
+	if g.MinElevation != nil && g.MaxElevation != nil && *g.MinElevation > *g.MaxElevation {
+		problems = append(problems, fmt.Sprintf("min_elevation (%vm) must not be above max_elevation (%vm)", float64(*g.MinElevation), float64(*g.MaxElevation)))
+	}
+	if len(g.Geofences) > 0 {
+		if g.Radius != 0 || len(g.Polygon) > 0 || g.Location != "" || g.Center != (Point{}) {
+			problems = append(problems, "must set either geofences or its own geo_center, location, geo_radius, or geo_polygon, not both")
+		}
+		switch g.Match {
+		case "", GeofenceMatchAny, GeofenceMatchAll:
+		default:
+			problems = append(problems, fmt.Sprintf("match must be %s or %s, found %q", GeofenceMatchAny, GeofenceMatchAll, g.Match))
+		}
+		for i, geofence := range g.Geofences {
+			if !geofence.Defined() {
+				problems = append(problems, fmt.Sprintf("geofences %d must set a geo_radius, geo_polygon, or geofences", i+1))
+			}
+			for _, problem := range geofence.validate() {
+				problems = append(problems, fmt.Sprintf("geofences %d %s", i+1, problem))
+			}
+		}
+		return problems
+	}
+	if g.Match != "" {
+		problems = append(problems, "match only applies to geofences")
+	}
+	if len(g.Polygon) > 0 {
+		// polygons need at least 3 vertices to enclose an area
+		if len(g.Polygon) < 3 {
+			problems = append(problems, fmt.Sprintf("geo_polygon must have at least 3 points, found %d", len(g.Polygon)))
+		}
+		for _, point := range g.Polygon {
+			if !point.valid() {
+				problems = append(problems, fmt.Sprintf("geo_polygon point %v is out of range (lat must be within ±90, lng within ±180)", point))
+			}
+		}
+		return problems
+	}
+	if g.Radius < 0 {
+		problems = append(problems, fmt.Sprintf("geo_radius must be positive, found %vm", float64(g.Radius)))
+	}
+	if g.Radius != 0 && !g.Center.valid() {
+		problems = append(problems, fmt.Sprintf("geo_center %v is out of range (lat must be within ±90, lng within ±180); are lat and lng swapped?", g.Center))
+	}
+	return problems
+}
+
+// returns true if the point is a valid latitude and longitude
+func (p Point) valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// returns true if a start and end have been configured for the active hours
+func (a ActiveHours) Defined() bool {
+	return a.Start != "" || a.End != ""
+}
+
+// returns true if action is allowed at the given time; always true if the active hours aren't defined,
+// don't apply to the action, or can't be parsed (which Validate reports)
+func (a ActiveHours) Allows(action string, now time.Time) bool {
+	if !a.Defined() || !a.appliesTo(action) {
+		return true
+	}
+	start, errStart := time.Parse("15:04", a.Start)
+	end, errEnd := time.Parse("15:04", a.End)
+	location, errLocation := time.LoadLocation(a.Timezone)
+	if errStart != nil || errEnd != nil || errLocation != nil {
+		return true
+	}
+
+	now = now.In(location)
+	minute := now.Hour()*60 + now.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+	if startMinute <= endMinute {
+		return minute >= startMinute && minute < endMinute
+	}
+	return minute >= startMinute || minute < endMinute // window crosses midnight
+}
+
+// returns true if the active hours limit the action
+func (a ActiveHours) appliesTo(action string) bool {
+	if len(a.Actions) == 0 {
+		return true
+	}
+	for _, limited := range a.Actions {
+		if strings.EqualFold(limited, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the problems with the active hours' configuration, if any
+func (a ActiveHours) validate() []string {
+	if !a.Defined() {
+		return nil
+	}
+	var problems []string
+	if _, err := time.Parse("15:04", a.Start); err != nil {
+		problems = append(problems, fmt.Sprintf("start must be a 24h time like 07:00, found %q", a.Start))
+	}
+	if _, err := time.Parse("15:04", a.End); err != nil {
+		problems = append(problems, fmt.Sprintf("end must be a 24h time like 21:00, found %q", a.End))
+	}
+	if _, err := time.LoadLocation(a.Timezone); err != nil {
+		problems = append(problems, fmt.Sprintf("timezone %q is invalid: %v", a.Timezone, err))
+	}
+	for _, action := range a.Actions {
+		if !strings.EqualFold(action, "open") && !strings.EqualFold(action, "close") {
+			problems = append(problems, fmt.Sprintf("actions must be open or close, found %q", action))
+		}
+	}
+	return problems
+}
+
+// car values that can be read from teslamate's topics
+const (
+	FieldGeofence  = "geofence"
+	FieldLatitude  = "latitude"
+	FieldLongitude = "longitude"
+	FieldSpeed     = "speed"
+	FieldElevation = "elevation"
+	FieldPluggedIn = "plugged_in"
+	FieldLocation  = "location"
+)
+
+// returns the topic under mqtt_topic_prefix/<teslamate_car_id>/ that the field is read from, or "" for the
+// location field if it isn't used
+func (m Topics) Topic(field string) string {
+	switch field {
+	case FieldGeofence:
+		return orDefault(m.Geofence, field)
+	case FieldLatitude:
+		return orDefault(m.Latitude, field)
+	case FieldLongitude:
+		return orDefault(m.Longitude, field)
+	case FieldSpeed:
+		return orDefault(m.Speed, field)
+	case FieldElevation:
+		return orDefault(m.Elevation, field)
+	case FieldPluggedIn:
+		return orDefault(m.PluggedIn, field)
+	case FieldLocation:
+		return m.Location
+	}
+	return ""
+}
+
+// returns the fields that are read, keyed by their topic under mqtt_topic_prefix/<teslamate_car_id>/
+func (m Topics) Fields() map[string]string {
+	byTopic := map[string]string{}
+	for _, field := range m.fields() {
+		byTopic[m.Topic(field)] = field
+	}
+	return byTopic
+}
+
+// returns the fields that are read; with a location topic, coordinates are only read from it
+func (m Topics) fields() []string {
+	if m.Location != "" {
+		return []string{FieldGeofence, FieldLocation, FieldSpeed, FieldElevation, FieldPluggedIn}
+	}
+	return []string{FieldGeofence, FieldLatitude, FieldLongitude, FieldSpeed, FieldElevation, FieldPluggedIn}
+}
+
+// returns the dot separated paths to the latitude and longitude in the location message
+func (m Topics) LocationPaths() (lat string, lng string) {
+	return orDefault(m.LocationLatPath, FieldLatitude), orDefault(m.LocationLngPath, FieldLongitude)
+}
+
+// returns a description of each problem with the topics
+func (m Topics) validate() []string {
+	var problems []string
+	seen := map[string]string{}
+	for _, field := range m.fields() {
+		topic := m.Topic(field)
+		if strings.ContainsAny(topic, "/+#") {
+			problems = append(problems, fmt.Sprintf("%s must be a single topic level without mqtt wildcards, found %q", field, topic))
+		}
+		if other, ok := seen[topic]; ok {
+			problems = append(problems, fmt.Sprintf("%s and %s can't both be read from topic %q", other, field, topic))
+		}
+		seen[topic] = field
+	}
+	lat, lng := m.LocationPaths()
+	for _, path := range []string{lat, lng} {
+		if slices.Contains(strings.Split(path, "."), "") {
+			problems = append(problems, fmt.Sprintf("location paths must be dot separated keys, found %q", path))
+		}
+	}
+	return problems
+}
+
+// returns value, or def if value isn't set
+func orDefault[T comparable](value T, def T) T {
+	var zero T
+	if value == zero {
+		return def
+	}
+	return value
+}